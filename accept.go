@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxAcceptCacheEntries bounds the amount of distinct Accept-Encoding headers
+// we keep parsed.
+const maxAcceptCacheEntries = 512
+
+// acceptEncoding is a parsed Accept-Encoding header, as per RFC 9110, section
+// 12.5.3.
+type acceptEncoding struct {
+	// codings maps the explicitly listed content-codings to their quality.
+	codings map[string]float64
+
+	// wildcard is the quality of "*", if listed.
+	wildcard    float64
+	hasWildcard bool
+}
+
+// quality returns the quality the client assigned to a content-coding. A
+// quality of 0 means that the coding is not acceptable.
+func (a *acceptEncoding) quality(coding string) float64 {
+	if q, exists := a.codings[coding]; exists {
+		return q
+	}
+	if a.hasWildcard {
+		return a.wildcard
+	}
+	if coding == "identity" {
+		// Identity is acceptable unless explicitly excluded, but we do not
+		// want it to win over codings the client asked for, so it gets the
+		// lowest possible quality.
+		return 0.001
+	}
+	return 0
+}
+
+// negotiate picks the variant to serve from the candidates, which must be in
+// order of server preference. Ties are broken by server preference, with
+// identity preferred last. A nil variant means identity. If no representation
+// is acceptable, ok is false.
+func (a *acceptEncoding) negotiate(variants []*variant) (best *variant, ok bool) {
+	var bestq float64
+	for _, v := range variants {
+		if q := a.quality(v.encoding.name); q > bestq {
+			best, bestq = v, q
+		}
+	}
+
+	if q := a.quality("identity"); q > bestq {
+		return nil, true
+	}
+
+	return best, bestq > 0
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header. Entries that cannot be
+// parsed are skipped.
+func parseAcceptEncoding(s string) *acceptEncoding {
+	a := &acceptEncoding{
+		codings: make(map[string]float64),
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		params := strings.Split(entry, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		// RFC 9110 asks us to treat x-gzip as gzip.
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) < 2 || (param[0] != 'q' && param[0] != 'Q') || param[1] != '=' {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(param[2:], 64); err != nil || q < 0 || q > 1 {
+				q = -1
+			}
+		}
+		if q < 0 {
+			continue
+		}
+
+		if coding == "*" {
+			a.wildcard = q
+			a.hasWildcard = true
+			continue
+		}
+		a.codings[coding] = q
+	}
+
+	return a
+}
+
+// acceptCache caches parsed Accept-Encoding headers. Clients only send a
+// handful of distinct headers, so this keeps the parsing off the hot path. Once
+// the cache is full, new headers are parsed without being cached.
+var acceptCache = struct {
+	sync.RWMutex
+	m map[string]*acceptEncoding
+}{
+	m: make(map[string]*acceptEncoding),
+}
+
+// identityOnly is used for requests without Accept-Encoding. RFC 9110 permits
+// any coding in that case, but identity is the only safe choice in practice.
+var identityOnly = &acceptEncoding{
+	codings: map[string]float64{"identity": 1},
+}
+
+// getAcceptEncoding returns the parsed Accept-Encoding header of a request.
+func getAcceptEncoding(h http.Header) *acceptEncoding {
+	s, exists := quickHeaderGet("Accept-Encoding", h)
+	if !exists {
+		return identityOnly
+	}
+
+	acceptCache.RLock()
+	a, exists := acceptCache.m[s]
+	acceptCache.RUnlock()
+	if exists {
+		return a
+	}
+
+	a = parseAcceptEncoding(s)
+
+	acceptCache.Lock()
+	if len(acceptCache.m) < maxAcceptCacheEntries {
+		acceptCache.m[s] = a
+	}
+	acceptCache.Unlock()
+
+	return a
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAcceptEncodingQuality(t *testing.T) {
+	tests := []struct {
+		header string
+		coding string
+		q      float64
+	}{
+		{"", "gzip", 0},
+		{"", "identity", 0.001},
+		{"gzip", "gzip", 1},
+		{"gzip", "br", 0},
+		{"x-gzip", "gzip", 1},
+		{"GZIP;Q=0.5", "gzip", 0.5},
+		{"gzip;q=0", "gzip", 0},
+		{"gzip;q=2, br", "gzip", 0},
+		{"gzip;q=abc, br", "br", 1},
+		{"*", "br", 1},
+		{"*;q=0.3", "identity", 0.3},
+		{"br, *;q=0", "br", 1},
+		{"br, *;q=0", "gzip", 0},
+		{"br, *;q=0", "identity", 0},
+		{"identity;q=0", "identity", 0},
+		{"identity;q=0, *", "identity", 0},
+	}
+
+	for _, tt := range tests {
+		if q := parseAcceptEncoding(tt.header).quality(tt.coding); q != tt.q {
+			t.Errorf("parseAcceptEncoding(%q).quality(%q) = %v, expected %v", tt.header, tt.coding, q, tt.q)
+		}
+	}
+}
+
+func TestAcceptEncodingNegotiate(t *testing.T) {
+	var (
+		br       = &variant{encoding: encodingBrotli}
+		gzip     = &variant{encoding: encodingGZIP}
+		variants = []*variant{br, gzip}
+	)
+
+	tests := []struct {
+		header   string
+		variants []*variant
+		best     *variant
+		ok       bool
+	}{
+		{"", variants, nil, true},
+		{"gzip", variants, gzip, true},
+		{"gzip, br", variants, br, true},
+		{"gzip, br;q=0.5", variants, gzip, true},
+		{"br;q=0, gzip;q=0", variants, nil, true},
+		{"*", variants, br, true},
+		{"*;q=0", variants, nil, false},
+		{"*;q=0, identity", variants, nil, true},
+		{"identity;q=0", variants, nil, false},
+		{"identity;q=0", nil, nil, false},
+		{"identity;q=0, gzip", variants, gzip, true},
+		{"identity, gzip;q=0.5", variants, nil, true},
+	}
+
+	for _, tt := range tests {
+		best, ok := parseAcceptEncoding(tt.header).negotiate(tt.variants)
+		if best != tt.best || ok != tt.ok {
+			t.Errorf("negotiate for %q = %v, %v, expected %v, %v", tt.header, best, ok, tt.best, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipList is a list of networks.
+type ipList []*net.IPNet
+
+// parseIPList parses a list of CIDR networks. Plain addresses are accepted as
+// networks containing only that address.
+func parseIPList(l []string) (ipList, error) {
+	var nets ipList
+	for _, s := range l {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (l ipList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessRule restricts access to a path prefix by client address.
+type accessRule struct {
+	prefix      string
+	allow, deny ipList
+}
+
+// permits reports whether ip may access the paths of the rule. Deny takes
+// precedence over allow, and an empty allow list allows everyone.
+func (a *accessRule) permits(ip net.IP) bool {
+	if a.deny.contains(ip) {
+		return false
+	}
+	return len(a.allow) == 0 || a.allow.contains(ip)
+}
+
+// accessPolicy holds the address restrictions of a site.
+type accessPolicy struct {
+	// rules holds the site-wide rule first, followed by the path rules. A
+	// request must be permitted by every rule matching its path.
+	rules []*accessRule
+
+	// trusted lists the proxies whose X-Forwarded-For we trust.
+	trusted ipList
+}
+
+// newAccessPolicy compiles the access section of a site configuration. If the
+// section has neither restrictions nor trusted proxies, nil is returned.
+func newAccessPolicy(conf *SiteConfigAccess) (*accessPolicy, error) {
+	if len(conf.Allow) == 0 && len(conf.Deny) == 0 && len(conf.Rules) == 0 && len(conf.TrustedProxies) == 0 {
+		return nil, nil
+	}
+
+	var (
+		err    error
+		policy = &accessPolicy{}
+	)
+
+	if policy.trusted, err = parseIPList(conf.TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	rules := append([]SiteConfigAccessRule{{
+		Path:  "/",
+		Allow: conf.Allow,
+		Deny:  conf.Deny,
+	}}, conf.Rules...)
+
+	for _, r := range rules {
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, fmt.Errorf("access path %q must start with /", r.Path)
+		}
+		rule := &accessRule{prefix: r.Path}
+		if rule.allow, err = parseIPList(r.Allow); err != nil {
+			return nil, err
+		}
+		if rule.deny, err = parseIPList(r.Deny); err != nil {
+			return nil, err
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+
+	return policy, nil
+}
+
+// clientIP returns the address of the client of a request. If the request
+// came from a trusted proxy, X-Forwarded-For is followed from the right until
+// an untrusted address is found.
+func (a *accessPolicy) clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !a.trusted.contains(ip) {
+		return ip
+	}
+
+	forwarded := strings.Join(req.Header["X-Forwarded-For"], ",")
+	hops := strings.Split(forwarded, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !a.trusted.contains(ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// permits reports whether a request for the cleaned path p is permitted.
+func (a *accessPolicy) permits(req *http.Request, p string) bool {
+	ip := a.clientIP(req)
+	if ip == nil {
+		return false
+	}
+	for _, rule := range a.rules {
+		if strings.HasPrefix(p, rule.prefix) && !rule.permits(ip) {
+			return false
+		}
+	}
+	return true
+}
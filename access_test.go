@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseIPList(t *testing.T) {
+	tests := []struct {
+		list []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{"192.0.2.1", "198.51.100.0/24"}, true},
+		{[]string{"2001:db8::1", "2001:db8::/32"}, true},
+		{[]string{"192.0.2.256"}, false},
+		{[]string{"192.0.2.0/33"}, false},
+		{[]string{"example.com"}, false},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseIPList(tt.list); (err == nil) != tt.ok {
+			t.Errorf("parseIPList(%q): error %v, expected success %v", tt.list, err, tt.ok)
+		}
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	conf := &SiteConfigAccess{
+		Allow:          []string{"192.0.2.0/24", "2001:db8::/32", "203.0.113.7"},
+		Deny:           []string{"192.0.2.66", "2001:db8:bad::/48"},
+		TrustedProxies: []string{"192.0.2.1"},
+		Rules: []SiteConfigAccessRule{
+			{Path: "/admin/", Allow: []string{"192.0.2.10", "2001:db8::10"}},
+			{Path: "/admin/open/", Deny: []string{"192.0.2.10"}},
+		},
+	}
+	policy, err := newAccessPolicy(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		path      string
+		permitted bool
+	}{
+		{"192.0.2.5:1234", "", "/", true},
+		{"203.0.113.7:1234", "", "/", true},
+		{"203.0.113.8:1234", "", "/", false},
+		{"[2001:db8::5]:1234", "", "/", true},
+		{"[2001:db9::5]:1234", "", "/", false},
+
+		// Deny takes precedence over allow.
+		{"192.0.2.66:1234", "", "/", false},
+		{"[2001:db8:bad::1]:1234", "", "/", false},
+
+		// IPv4-mapped IPv6 addresses match IPv4 networks.
+		{"[::ffff:192.0.2.5]:1234", "", "/", true},
+		{"[::ffff:192.0.2.66]:1234", "", "/", false},
+
+		// Path rules apply on top of the site-wide rule.
+		{"192.0.2.5:1234", "", "/admin/", false},
+		{"192.0.2.10:1234", "", "/admin/", true},
+		{"[2001:db8::10]:1234", "", "/admin/x", true},
+		{"[2001:db8::11]:1234", "", "/admin/x", false},
+		{"192.0.2.10:1234", "", "/admin/open/", false},
+		{"192.0.2.10:1234", "", "/administrator", true},
+
+		// X-Forwarded-For is only followed from trusted proxies.
+		{"192.0.2.1:1234", "203.0.113.8", "/", false},
+		{"192.0.2.1:1234", "203.0.113.8, 192.0.2.5", "/", true},
+		{"192.0.2.1:1234", "192.0.2.5, 203.0.113.8", "/", false},
+		{"192.0.2.5:1234", "192.0.2.66", "/", true},
+		{"192.0.2.1:1234", "garbage", "/", true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+		req.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if permitted := policy.permits(req, tt.path); permitted != tt.permitted {
+			t.Errorf("%s via %q for %s: permitted %v, expected %v", tt.remote, tt.forwarded, tt.path, permitted, tt.permitted)
+		}
+	}
+}
+
+func TestHTTPAccessDenied(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[access]
+deny = ["192.0.2.0/24"]
+`,
+		"example.com/common/index.html": "hello",
+		"example.com/common/403.html":   "go away",
+	})
+
+	for _, tt := range []struct {
+		remote string
+		status int
+		body   string
+	}{
+		{"192.0.2.1:1234", http.StatusForbidden, "go away"},
+		{"198.51.100.1:1234", http.StatusOK, "hello"},
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		sl.http(w, req)
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, expected %d %q", tt.remote, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+}
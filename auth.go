@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+import "golang.org/x/crypto/bcrypt"
+
+// maxVerifiedCredentials bounds the amount of verified credentials an auth
+// rule remembers.
+const maxVerifiedCredentials = 1024
+
+// authRule protects a path prefix of a site with HTTP Basic authentication.
+// Rules from path blocks protect the paths matching their pattern instead.
+type authRule struct {
+	prefix string
+	match  string
+	realm  string
+
+	// users maps user names to their htpasswd hashes.
+	users map[string]string
+
+	// verified holds the Authorization headers that have been verified.
+	// bcrypt is slow on purpose, and we do not want to pay for it on every
+	// request from the same client.
+	verified     map[string]bool
+	verifiedLock sync.RWMutex
+}
+
+// readHtpasswd reads an htpasswd file. Only bcrypt and {SHA} entries are
+// supported. Entries that cannot be used are skipped and returned as errors.
+func readHtpasswd(p string) (map[string]string, []error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer f.Close()
+
+	var (
+		users = make(map[string]string)
+		errs  []error
+		n     int
+	)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			errs = append(errs, fmt.Errorf("%s:%d: missing password hash", p, n))
+			continue
+		}
+
+		user, hash := line[:i], line[i+1:]
+		switch {
+		case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		case strings.HasPrefix(hash, "{SHA}"):
+		default:
+			errs = append(errs, fmt.Errorf("%s:%d: unsupported hash for user %q", p, n, user))
+			continue
+		}
+		users[user] = hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return users, errs
+}
+
+// newAuthRule creates an auth rule from the site configuration, reading the
+// htpasswd file relative to the site directory. If the file cannot be read,
+// the rule is still returned, but denies everyone.
+func newAuthRule(conf SiteConfigAuth, dir string) (*authRule, []error) {
+	file := conf.File
+	if !path.IsAbs(file) {
+		file = path.Join(dir, file)
+	}
+
+	users, errs := readHtpasswd(file)
+	return &authRule{
+		prefix:   conf.Path,
+		realm:    conf.Realm,
+		users:    users,
+		verified: make(map[string]bool),
+	}, errs
+}
+
+// check verifies the credentials of a request. It returns the user name that
+// was tried, if any, and whether the credentials were valid.
+func (a *authRule) check(h http.Header) (string, bool) {
+	authorization, exists := quickHeaderGet("Authorization", h)
+	if !exists {
+		return "", false
+	}
+
+	const prefix = "Basic "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return "", false
+	}
+
+	i := strings.IndexByte(string(b), ':')
+	if i < 0 {
+		return "", false
+	}
+	user, password := string(b[:i]), string(b[i+1:])
+
+	a.verifiedLock.RLock()
+	verified := a.verified[authorization]
+	a.verifiedLock.RUnlock()
+	if verified {
+		return user, true
+	}
+
+	hash, exists := a.users[user]
+	if !exists {
+		return user, false
+	}
+
+	var ok bool
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		ok = subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	} else {
+		ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	if ok {
+		a.verifiedLock.Lock()
+		if len(a.verified) < maxVerifiedCredentials {
+			a.verified[authorization] = true
+		}
+		a.verifiedLock.Unlock()
+	}
+
+	return user, ok
+}
+
+// challenge returns the WWW-Authenticate header value for the rule.
+func (a *authRule) challenge() string {
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.realm)
+}
+
+// matches reports whether the rule protects p.
+func (a *authRule) matches(p string) bool {
+	if a.match != "" {
+		return matchPath(a.match, p)
+	}
+	return strings.HasPrefix(p, a.prefix)
+}
+
+// authFor returns the auth rule protecting p, if any. The rules of the last
+// matching path block take precedence. Otherwise, if several auth blocks
+// match, the one with the longest prefix is used.
+func (s *site) authFor(p string) *authRule {
+	for _, a := range s.auth {
+		if a.matches(p) {
+			return a
+		}
+	}
+	return nil
+}
+
+// protects reports whether the resource served at sitepath is protected by
+// an auth block or by the auth section of a path block.
+func (c *SiteConfig) protects(sitepath string) bool {
+	for _, a := range c.Auth {
+		if strings.HasPrefix(sitepath, a.Path) {
+			return true
+		}
+	}
+	for _, p := range c.Path {
+		if p.Auth != nil && matchPath(p.Match, sitepath) {
+			return true
+		}
+	}
+	return false
+}
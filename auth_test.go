@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+import "golang.org/x/crypto/bcrypt"
+
+// basicAuth returns the Authorization header value for the credentials.
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// shaEntry returns an htpasswd line with a {SHA} hash of password.
+func shaEntry(user, password string) string {
+	sum := sha1.Sum([]byte(password))
+	return user + ":{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n"
+}
+
+func TestReadHtpasswd(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "htpasswd")
+	err := os.WriteFile(p, []byte(strings.Join([]string{
+		"# comment",
+		"",
+		"a:$2y$05$abcdefghijklmnopqrstuu5Bh7Gt9Y8v8Fbaa6p0yTz9hL1cDtk9S",
+		"b:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=",
+		"c:$apr1$salt$hash",
+		"d",
+	}, "\n")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, errs := readHtpasswd(p)
+	if len(users) != 2 || users["a"] == "" || users["b"] == "" {
+		t.Errorf("users %v, expected a and b", users)
+	}
+	if len(errs) != 2 {
+		t.Errorf("errors %v, expected 2", errs)
+	}
+}
+
+func TestHTTPBasicAuth(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("sha-secret"))
+	shaHash := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[[auth]]
+path = "/private/"
+realm = "Private"
+file = "htpasswd"
+`,
+		"example.com/htpasswd":                  "alice:" + string(bcryptHash) + "\nbob:" + shaHash + "\n",
+		"example.com/common/index.html":         "public",
+		"example.com/common/private/index.html": "private",
+	})
+
+	const challenge = `Basic realm="Private", charset="UTF-8"`
+
+	tests := []struct {
+		method        string
+		target        string
+		authorization string
+		status        int
+	}{
+		{"GET", "http://example.com/", "", http.StatusOK},
+		{"GET", "http://example.com/private/", "", http.StatusUnauthorized},
+		{"HEAD", "http://example.com/private/", "", http.StatusUnauthorized},
+		{"GET", "http://example.com/private/missing", "", http.StatusUnauthorized},
+		{"GET", "http://example.com/private/", basicAuth("alice", "wrong"), http.StatusUnauthorized},
+		{"GET", "http://example.com/private/", basicAuth("bob", "wrong"), http.StatusUnauthorized},
+		{"GET", "http://example.com/private/", basicAuth("mallory", "bcrypt-secret"), http.StatusUnauthorized},
+		{"GET", "http://example.com/private/", "Basic !!!", http.StatusUnauthorized},
+		{"GET", "http://example.com/private/", "Bearer token", http.StatusUnauthorized},
+		{"GET", "http://example.com/private/", basicAuth("alice", "bcrypt-secret"), http.StatusOK},
+		{"HEAD", "http://example.com/private/", basicAuth("alice", "bcrypt-secret"), http.StatusOK},
+		{"GET", "http://example.com/private/", basicAuth("bob", "sha-secret"), http.StatusOK},
+		{"GET", "http://example.com/private/", "basic " + basicAuth("bob", "sha-secret")[6:], http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		var h http.Header
+		if tt.authorization != "" {
+			h = http.Header{"Authorization": {tt.authorization}}
+		}
+		w := serve(sl, tt.method, tt.target, h)
+		if w.Code != tt.status {
+			t.Errorf("%s %s with %q: status %d, expected %d", tt.method, tt.target, tt.authorization, w.Code, tt.status)
+			continue
+		}
+
+		switch {
+		case w.Code == http.StatusUnauthorized:
+			if v := w.Header().Get("WWW-Authenticate"); v != challenge {
+				t.Errorf("%s %s: WWW-Authenticate %q, expected %q", tt.method, tt.target, v, challenge)
+			}
+		case strings.Contains(tt.target, "/private/"):
+			if v := w.Header().Get("Cache-Control"); !strings.HasPrefix(v, "private") {
+				t.Errorf("%s %s: Cache-Control %q, expected it to be private", tt.method, tt.target, v)
+			}
+		}
+	}
+}
+
+func TestHTTPBasicAuthLongestPrefix(t *testing.T) {
+	// The rule for the outer prefix comes first, so that the order of the
+	// configuration would pick it.
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[[auth]]
+path = "/docs/"
+realm = "Docs"
+file = "docs.htpasswd"
+
+[[auth]]
+path = "/docs/internal/"
+realm = "Internal"
+file = "internal.htpasswd"
+`,
+		"example.com/docs.htpasswd":                    shaEntry("alice", "alice-secret"),
+		"example.com/internal.htpasswd":                shaEntry("bob", "bob-secret"),
+		"example.com/common/docs/index.html":           "docs",
+		"example.com/common/docs/internal/index.html":  "internal",
+		"example.com/common/docs/internalx/index.html": "not internal",
+	})
+
+	tests := []struct {
+		target        string
+		authorization string
+		status        int
+		realm         string
+	}{
+		{"/docs/", "", http.StatusUnauthorized, "Docs"},
+		{"/docs/internal/", "", http.StatusUnauthorized, "Internal"},
+		{"/docs/internalx/", "", http.StatusUnauthorized, "Docs"},
+		{"/docs/", basicAuth("alice", "alice-secret"), http.StatusOK, ""},
+		{"/docs/", basicAuth("bob", "bob-secret"), http.StatusUnauthorized, "Docs"},
+		{"/docs/internal/", basicAuth("alice", "alice-secret"), http.StatusUnauthorized, "Internal"},
+		{"/docs/internal/", basicAuth("bob", "bob-secret"), http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		var h http.Header
+		if tt.authorization != "" {
+			h = http.Header{"Authorization": {tt.authorization}}
+		}
+		w := serve(sl, "GET", "http://example.com"+tt.target, h)
+		if w.Code != tt.status {
+			t.Errorf("%s with %q: status %d, expected %d", tt.target, tt.authorization, w.Code, tt.status)
+			continue
+		}
+		if tt.realm == "" {
+			continue
+		}
+		if v, expected := w.Header().Get("WWW-Authenticate"), `Basic realm="`+tt.realm+`", charset="UTF-8"`; v != expected {
+			t.Errorf("%s: WWW-Authenticate %q, expected %q", tt.target, v, expected)
+		}
+	}
+}
+
+func TestHTTPPathAuth(t *testing.T) {
+	// Path blocks protect the paths matching their pattern, before the auth
+	// blocks, and later path blocks before earlier ones.
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[[auth]]
+path = "/reports/"
+realm = "Reports"
+file = "reports.htpasswd"
+
+[[path]]
+match = "/reports/*.pdf"
+[path.auth]
+realm = "PDF"
+file = "pdf.htpasswd"
+
+[[path]]
+match = "/reports/secret.pdf"
+[path.auth]
+realm = "Secret"
+file = "secret.htpasswd"
+`,
+		"example.com/reports.htpasswd":          shaEntry("alice", "alice-secret"),
+		"example.com/pdf.htpasswd":              shaEntry("bob", "bob-secret"),
+		"example.com/secret.htpasswd":           shaEntry("carol", "carol-secret"),
+		"example.com/common/index.html":         "public",
+		"example.com/common/reports/index.html": "reports",
+		"example.com/common/reports/q1.pdf":     "q1",
+		"example.com/common/reports/secret.pdf": "secret",
+		"example.com/common/q1.pdf":             "public pdf",
+	})
+
+	tests := []struct {
+		target        string
+		authorization string
+		status        int
+		realm         string
+	}{
+		{"/q1.pdf", "", http.StatusOK, ""},
+		{"/reports/", "", http.StatusUnauthorized, "Reports"},
+		{"/reports/q1.pdf", "", http.StatusUnauthorized, "PDF"},
+		{"/reports/secret.pdf", "", http.StatusUnauthorized, "Secret"},
+		{"/reports/", basicAuth("alice", "alice-secret"), http.StatusOK, ""},
+		{"/reports/q1.pdf", basicAuth("alice", "alice-secret"), http.StatusUnauthorized, "PDF"},
+		{"/reports/q1.pdf", basicAuth("bob", "bob-secret"), http.StatusOK, ""},
+		{"/reports/secret.pdf", basicAuth("bob", "bob-secret"), http.StatusUnauthorized, "Secret"},
+		{"/reports/secret.pdf", basicAuth("carol", "carol-secret"), http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		var h http.Header
+		if tt.authorization != "" {
+			h = http.Header{"Authorization": {tt.authorization}}
+		}
+		w := serve(sl, "GET", "http://example.com"+tt.target, h)
+		if w.Code != tt.status {
+			t.Errorf("%s with %q: status %d, expected %d", tt.target, tt.authorization, w.Code, tt.status)
+			continue
+		}
+		if tt.realm == "" {
+			continue
+		}
+		if v, expected := w.Header().Get("WWW-Authenticate"), `Basic realm="`+tt.realm+`", charset="UTF-8"`; v != expected {
+			t.Errorf("%s: WWW-Authenticate %q, expected %q", tt.target, v, expected)
+		}
+	}
+
+	// Resources protected by path blocks are kept out of shared caches.
+	h := http.Header{"Authorization": {basicAuth("bob", "bob-secret")}}
+	if v := serve(sl, "GET", "http://example.com/reports/q1.pdf", h).Header().Get("Cache-Control"); !strings.HasPrefix(v, "private") {
+		t.Errorf("/reports/q1.pdf: Cache-Control %q, expected private", v)
+	}
+	if v := serve(sl, "GET", "http://example.com/q1.pdf", nil).Header().Get("Cache-Control"); strings.HasPrefix(v, "private") {
+		t.Errorf("/q1.pdf: Cache-Control %q, expected public", v)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// indexEntry is a single entry of a directory listing.
+type indexEntry struct {
+	Name    string    `json:"name"`
+	Href    string    `json:"href"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// indexPage is the data for the directory listing template.
+type indexPage struct {
+	Path    string
+	Parent  string
+	Entries []indexEntry
+}
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"unitize": func(i int64) string { return unitize(int(i)) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{- if .Parent}}
+<tr><td><a href="{{.Parent}}">../</a></td><td>-</td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{if .Dir}}-{{else}}{{unitize .Size}}{{end}}</td><td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// escapePath escapes the decoded path p for use in a link, so that characters
+// like #, ? and % in any of its elements are not taken for URL syntax.
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// readIndex lists the directory at diskpath, which is served at urlpath, as
+// per the autoindex settings of the site. Only the entries keep returns true
+// for are listed. Directories are always listed first.
+func readIndex(diskpath, urlpath string, conf *SiteConfigGeneral, keep func(string, os.FileInfo) bool) ([]indexEntry, error) {
+	files, err := ioutil.ReadDir(diskpath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Precompressed sidecar files are not served on their own, so they are
+	// not listed either.
+	regular := make(map[string]bool, len(files))
+	for _, fi := range files {
+		if !fi.IsDir() {
+			regular[fi.Name()] = true
+		}
+	}
+
+	entries := make([]indexEntry, 0, len(files))
+	for _, fi := range files {
+		name := fi.Name()
+		if !conf.AutoIndexHidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+		if isSidecar(name, regular) || !keep(name, fi) {
+			continue
+		}
+
+		// Symlinks that may be served are listed as what they point to.
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(path.Join(diskpath, name))
+			if err != nil {
+				continue
+			}
+			fi = target
+		}
+
+		href := escapePath(path.Join(urlpath, name))
+		if fi.IsDir() {
+			href += "/"
+		}
+
+		entries = append(entries, indexEntry{
+			Name:    name,
+			Href:    href,
+			Dir:     fi.IsDir(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+
+	var (
+		key     = strings.TrimPrefix(conf.AutoIndexSort, "-")
+		reverse = strings.HasPrefix(conf.AutoIndexSort, "-")
+	)
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		if reverse {
+			a, b = b, a
+		}
+		switch key {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "time":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return a.Name < b.Name
+	})
+
+	return entries, nil
+}
+
+// indexResource produces a directory listing resource for the directory at
+// diskpath, rendered as JSON or HTML, listing the entries keep returns true
+// for. The listing is treated as a from-disk resource, so it gets the same
+// cache and compression settings as files from the same folder.
+func indexResource(diskpath, urlpath string, fi os.FileInfo, asJSON bool, config *SiteConfig, keep func(string, os.FileInfo) bool) (*resource, error) {
+	entries, err := readIndex(diskpath, urlpath, config.General, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		buf     = new(bytes.Buffer)
+		cnttype string
+	)
+
+	if asJSON {
+		cnttype = "application/json"
+		err = json.NewEncoder(buf).Encode(entries)
+	} else {
+		cnttype = "text/html; charset=utf-8"
+		page := indexPage{
+			Path:    urlpath,
+			Entries: entries,
+		}
+		if urlpath != config.General.FancyFolder {
+			page.Parent = escapePath(path.Dir(strings.TrimSuffix(urlpath, "/")) + "/")
+		}
+		err = indexTemplate.Execute(buf, page)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &resource{
+		body:     buf.Bytes(),
+		path:     diskpath,
+		sitepath: urlpath,
+		config:   config.forPath(urlpath),
+		loaded:   fi.ModTime(),
+		fromDisk: true,
+		vary:     "Accept, Accept-Encoding",
+	}
+	r.hash = hash(r.body)
+	r.variants = encodeStream(r.body)
+	r.update()
+	r.cnttype = cnttype
+
+	return r, nil
+}
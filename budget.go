@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+)
+
+// budget tracks the memory used by resources during a load. A limit of 0
+// means no limit.
+type budget struct {
+	limit       int64
+	maxFileSize int64
+	used        int64
+}
+
+// fits reports whether n more bytes fit in the budget.
+func (b *budget) fits(n int64) bool {
+	return b.limit <= 0 || b.used+n <= b.limit
+}
+
+// status returns the line describing the budget for the status report.
+func (b *budget) status(name string) string {
+	limit := "unlimited"
+	if b.limit > 0 {
+		limit = unitize(int(b.limit))
+	}
+	line := fmt.Sprintf("\t%s: %s of %s", name, unitize(int(b.used)), limit)
+	if b.maxFileSize > 0 {
+		line += fmt.Sprintf(" (files up to %s)", unitize(int(b.maxFileSize)))
+	}
+	return line + "\n"
+}
+
+// spill records a file that is served from disk instead of memory.
+type spill struct {
+	sitepath string
+	size     int64
+	reason   string
+}
+
+// tooLarge returns the reason a file of size bytes is too large to be held in
+// memory. The maximum file size of the site takes precedence over the global
+// one. If the file is not too large, the empty string is returned.
+func (s *site) tooLarge(size int64, global *budget) string {
+	maxFileSize := global.maxFileSize
+	if s.budget.maxFileSize > 0 {
+		maxFileSize = s.budget.maxFileSize
+	}
+	if maxFileSize > 0 && size > maxFileSize {
+		return fmt.Sprintf("larger than %s", unitize(int(maxFileSize)))
+	}
+	return ""
+}
+
+// overBudget returns the reason size more bytes do not fit in memory, checking
+// the budget of the site before the global one. If they fit, the empty string
+// is returned.
+func (s *site) overBudget(size int64, global *budget) string {
+	if !s.budget.fits(size) {
+		return fmt.Sprintf("site memory budget of %s exhausted", unitize(int(s.budget.limit)))
+	}
+	if !global.fits(size) {
+		return fmt.Sprintf("memory budget of %s exhausted", unitize(int(global.limit)))
+	}
+	return ""
+}
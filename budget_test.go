@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// incompressible returns n bytes that no encoding makes smaller, so that a
+// file of them costs exactly n bytes of memory.
+func incompressible(seed int64, n int) string {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return string(b)
+}
+
+// statusReport fetches /status from the command server of the sitelist.
+func statusReport(sl *sitelist) string {
+	w := httptest.NewRecorder()
+	sl.cmdhttp(w, httptest.NewRequest("GET", "/status", nil))
+	return w.Body.String()
+}
+
+func TestHTTPMemoryBudget(t *testing.T) {
+	files := map[string]string{
+		"example.com/config.toml": `
+[memory]
+budget = "3KB"
+maxFileSize = 1536
+`,
+		"example.com/common/a.bin":   incompressible(1, 1024),
+		"example.com/common/b.bin":   incompressible(2, 1024),
+		"example.com/common/big.bin": incompressible(3, 1537),
+		"example.com/common/c.bin":   incompressible(4, 1024),
+		"example.com/common/d.bin":   "d",
+		"example.com/common/e.bin":   incompressible(1, 1024),
+	}
+	sl := newTestSitelist(t, files)
+
+	// Files are loaded in lexical order. a, b and c fill the budget exactly,
+	// so d no longer fits, while e duplicates a and costs nothing. big is
+	// larger than the maximum file size.
+	s := sl.sites["example.com"]
+	for name, spilled := range map[string]bool{
+		"/a.bin":   false,
+		"/b.bin":   false,
+		"/big.bin": true,
+		"/c.bin":   false,
+		"/d.bin":   true,
+		"/e.bin":   false,
+	} {
+		r := s.http[name]
+		if r == nil {
+			t.Errorf("%s: not loaded", name)
+			continue
+		}
+		if r.spilled != spilled {
+			t.Errorf("%s: spilled %v, expected %v", name, r.spilled, spilled)
+		}
+
+		// Spilled files are still served, from disk.
+		w := serve(sl, "GET", "http://example.com"+name, nil)
+		if w.Code != http.StatusOK || w.Body.String() != files["example.com/common"+name] {
+			t.Errorf("%s: status %d with %d bytes", name, w.Code, w.Body.Len())
+		}
+	}
+	if s.budget.used != 3072 {
+		t.Errorf("site budget used %d, expected 3072", s.budget.used)
+	}
+
+	status := statusReport(sl)
+	for _, line := range []string{
+		"\texample.com: 3.0KB of 3.0KB (files up to 1.5KB)\n",
+		"\texample.com/big.bin (1.5KB): larger than 1.5KB\n",
+		"\texample.com/d.bin (1B): site memory budget of 3.0KB exhausted\n",
+	} {
+		if !strings.Contains(status, line) {
+			t.Errorf("status lacks %q:\n%s", line, status)
+		}
+	}
+
+	// The global budget applies on top of that of the site.
+	sl.memory.limit = 2048
+	if err := sl.load(); err != nil {
+		t.Fatal(err)
+	}
+	s = sl.sites["example.com"]
+	if !s.http["/c.bin"].spilled || s.http["/b.bin"].spilled || sl.memory.used != 2048 {
+		t.Errorf("global budget of 2048 bytes: c spilled %v, b spilled %v, %d bytes used", s.http["/c.bin"].spilled, s.http["/b.bin"].spilled, sl.memory.used)
+	}
+	status = statusReport(sl)
+	for _, line := range []string{
+		"\tGlobal: 2.0KB of 2.0KB (files up to " + unitize(int(DefaultMemoryMaxFileSize.Bytes)) + ")\n",
+		"\texample.com/c.bin (1024B): memory budget of 2.0KB exhausted\n",
+	} {
+		if !strings.Contains(status, line) {
+			t.Errorf("status lacks %q:\n%s", line, status)
+		}
+	}
+}
+
+func TestHTTPMemoryBudgetUpgrade(t *testing.T) {
+	// a.jpg is not compressed, as .jpg is blacklisted. b.txt has the same
+	// content, which is compressed when b.txt is loaded, and the compressed
+	// variants must fit in the budget like new content.
+	plain := strings.Repeat("hello world ", 200)
+	for _, tt := range []struct {
+		budget  string
+		spilled bool
+	}{
+		{"4KB", false},
+		{"2410", true},
+	} {
+		sl := newTestSitelist(t, map[string]string{
+			"example.com/config.toml":  "[memory]\nbudget = \"" + tt.budget + "\"\n",
+			"example.com/common/a.jpg": plain,
+			"example.com/common/b.txt": plain,
+		})
+
+		s := sl.sites["example.com"]
+		if r := s.http["/b.txt"]; r == nil || r.spilled != tt.spilled {
+			t.Errorf("budget %s: b.txt not loaded or spilled, expected spilled %v", tt.budget, tt.spilled)
+		}
+		if s.budget.used > s.budget.limit {
+			t.Errorf("budget %s: %d bytes used", tt.budget, s.budget.used)
+		}
+		if !tt.spilled && s.budget.used <= int64(len(plain)) {
+			t.Errorf("budget %s: %d bytes used, expected the compressed variants to be charged", tt.budget, s.budget.used)
+		}
+
+		w := serve(sl, "GET", "http://example.com/b.txt", http.Header{"Accept-Encoding": {"gzip"}})
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("budget %s: status %d with Content-Encoding %q", tt.budget, w.Code, w.Header().Get("Content-Encoding"))
+		}
+	}
+}
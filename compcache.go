@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// compressedEntry is a compressed body held by a compressionCache.
+type compressedEntry struct {
+	key  string
+	body []byte
+}
+
+// compressionCall is a compression in progress. Requests for the same key wait
+// for it to finish, rather than compressing the file again.
+type compressionCall struct {
+	done chan struct{}
+	body []byte
+	err  error
+}
+
+// compressionCache holds the compressed bodies of from-disk resources, so that
+// popular files are not compressed again for every request. It is bounded in
+// size, evicting the least recently used entries first.
+type compressionCache struct {
+	max         int64
+	maxFileSize int64
+
+	lock    sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	calls   map[string]*compressionCall
+
+	// stats
+	hits      uint64
+	misses    uint64
+	coalesced uint64
+	evictions uint64
+}
+
+// newCompressionCache returns a compression cache holding up to max bytes, and
+// only caching files of up to maxFileSize bytes.
+func newCompressionCache(max, maxFileSize int64) *compressionCache {
+	return &compressionCache{
+		max:         max,
+		maxFileSize: maxFileSize,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+		calls:       make(map[string]*compressionCall),
+	}
+}
+
+// cacheable reports whether a file of size bytes should go through the cache.
+// Larger files are compressed on the fly instead, as we would otherwise have
+// to compress them completely before sending the first byte.
+func (c *compressionCache) cacheable(size int64) bool {
+	return c != nil && size <= c.maxFileSize && size <= c.max
+}
+
+// key returns the cache key of a variant of the file at diskpath. The entity
+// tag of from-disk variants holds the modification time, size and encoding of
+// the file, so a changed file gets a new key.
+func (c *compressionCache) key(diskpath string, v *variant) string {
+	return diskpath + "\x00" + v.hash
+}
+
+// get returns the body cached for key. If there is none, src is compressed
+// with enc and cached. Concurrent requests for the same key share one
+// compression.
+func (c *compressionCache) get(key string, enc *encoding, src io.Reader) ([]byte, error) {
+	c.lock.Lock()
+	if elem, exists := c.entries[key]; exists {
+		c.lru.MoveToFront(elem)
+		c.hits++
+		c.lock.Unlock()
+		return elem.Value.(*compressedEntry).body, nil
+	}
+	if call, exists := c.calls[key]; exists {
+		c.coalesced++
+		c.lock.Unlock()
+		<-call.done
+		return call.body, call.err
+	}
+	call := &compressionCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.misses++
+	c.lock.Unlock()
+
+	buf := new(bytes.Buffer)
+	ew := enc.writer(buf)
+	_, call.err = io.Copy(ew, src)
+	if err := ew.Close(); call.err == nil {
+		call.err = err
+	}
+	call.body = buf.Bytes()
+
+	c.lock.Lock()
+	delete(c.calls, key)
+	if call.err == nil {
+		c.add(key, call.body)
+	}
+	c.lock.Unlock()
+	close(call.done)
+
+	return call.body, call.err
+}
+
+// peek returns the body cached for key, if any, without compressing anything
+// on a miss.
+func (c *compressionCache) peek(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.hits++
+	return elem.Value.(*compressedEntry).body, true
+}
+
+// add inserts a body, evicting entries until the cache fits within its size.
+// The lock must be held.
+func (c *compressionCache) add(key string, body []byte) {
+	if int64(len(body)) > c.max {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&compressedEntry{key: key, body: body})
+	c.size += int64(len(body))
+
+	for c.size > c.max {
+		elem := c.lru.Back()
+		e := elem.Value.(*compressedEntry)
+		c.lru.Remove(elem)
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.body))
+		c.evictions++
+	}
+}
+
+// status returns the lines describing the cache for the status report.
+func (c *compressionCache) status() string {
+	if c == nil {
+		return "\tDisabled\n"
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return fmt.Sprintf(`	Size:      %s of %s (%d entries, files up to %s)
+	Hits:      %d
+	Misses:    %d
+	Coalesced: %d
+	Evictions: %d
+`,
+		unitize(int(c.size)), unitize(int(c.max)), len(c.entries), unitize(int(c.maxFileSize)),
+		c.hits, c.misses, c.coalesced, c.evictions)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// nopWriteCloser adds a no-op Close to an io.Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// countingEncoding returns an encoding that copies its input as is, counting
+// how often it is used.
+func countingEncoding(n *int32) *encoding {
+	return &encoding{
+		name: "identity",
+		writer: func(w io.Writer) io.WriteCloser {
+			atomic.AddInt32(n, 1)
+			return nopWriteCloser{w}
+		},
+	}
+}
+
+// blockingReader blocks reads until release is closed.
+type blockingReader struct {
+	release chan struct{}
+	r       io.Reader
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	<-b.release
+	return b.r.Read(p)
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, c *compressionCache, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		c.lock.Lock()
+		ok := cond()
+		c.lock.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
+
+func TestCompressionCacheEviction(t *testing.T) {
+	var (
+		n   int32
+		enc = countingEncoding(&n)
+		c   = newCompressionCache(10, 10)
+	)
+
+	get := func(key, body string) {
+		t.Helper()
+		b, err := c.get(key, enc, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != body {
+			t.Errorf("get(%q) = %q, expected %q", key, b, body)
+		}
+	}
+
+	get("a", "aaaa")
+	get("b", "bbbb")
+	get("a", "aaaa")
+	get("c", "cccc")
+
+	// a was used more recently than b, so b is evicted to make room for c.
+	for key, cached := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, exists := c.entries[key]; exists != cached {
+			t.Errorf("%s cached %v, expected %v", key, exists, cached)
+		}
+	}
+	if c.size != 8 || c.hits != 1 || c.misses != 3 || c.evictions != 1 {
+		t.Errorf("size %d, %d hits, %d misses and %d evictions, expected 8, 1, 3 and 1", c.size, c.hits, c.misses, c.evictions)
+	}
+	if n != 3 {
+		t.Errorf("%d compressions, expected 3", n)
+	}
+
+	// Bodies larger than the cache are returned, but not cached.
+	get("d", "ddddddddddd")
+	if _, exists := c.entries["d"]; exists || c.size != 8 {
+		t.Errorf("oversized body cached, size %d", c.size)
+	}
+}
+
+func TestCompressionCacheCoalescing(t *testing.T) {
+	const waiters = 8
+
+	var (
+		n       int32
+		enc     = countingEncoding(&n)
+		c       = newCompressionCache(1024, 1024)
+		src     = &blockingReader{release: make(chan struct{}), r: strings.NewReader("body")}
+		wg      sync.WaitGroup
+		results = make([][]byte, waiters+1)
+	)
+
+	request := func(i int) {
+		defer wg.Done()
+		b, err := c.get("key", enc, src)
+		if err != nil {
+			t.Error(err)
+		}
+		results[i] = b
+	}
+
+	// The first request starts compressing, and blocks reading the source.
+	// The others arrive while it is in progress, and wait for it.
+	wg.Add(1)
+	go request(0)
+	waitFor(t, c, func() bool { return c.calls["key"] != nil })
+
+	wg.Add(waiters)
+	for i := 1; i <= waiters; i++ {
+		go request(i)
+	}
+	waitFor(t, c, func() bool { return c.coalesced == waiters })
+
+	close(src.release)
+	wg.Wait()
+
+	if n != 1 {
+		t.Errorf("%d compressions, expected 1", n)
+	}
+	for i, b := range results {
+		if !bytes.Equal(b, []byte("body")) {
+			t.Errorf("request %d got %q", i, b)
+		}
+	}
+	if c.misses != 1 || c.coalesced != waiters || len(c.calls) != 0 {
+		t.Errorf("%d misses, %d coalesced and %d calls, expected 1, %d and 0", c.misses, c.coalesced, len(c.calls), waiters)
+	}
+}
+
+func TestHTTPCompressionCache(t *testing.T) {
+	plain := strings.Repeat("compress me ", 1024)
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/fancy/f/file.txt": plain,
+	})
+	sl.compressed = newCompressionCache(1024*1024, 1024*1024)
+
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		w := serve(sl, "GET", "http://example.com/f/file.txt", http.Header{"Accept-Encoding": {"gzip"}})
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("status %d with Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+		}
+		bodies = append(bodies, w.Body.String())
+	}
+
+	if bodies[0] != bodies[1] || bodies[1] != bodies[2] {
+		t.Errorf("cached bodies differ")
+	}
+	if c := sl.compressed; c.misses != 1 || c.hits != 2 || len(c.entries) != 1 {
+		t.Errorf("%d misses, %d hits and %d entries, expected 1, 2 and 1", c.misses, c.hits, len(c.entries))
+	}
+}
+
+func TestHTTPCompressionCacheHead(t *testing.T) {
+	plain := strings.Repeat("compress me ", 1024)
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/fancy/f/file.txt": plain,
+	})
+	sl.compressed = newCompressionCache(1024*1024, 1024*1024)
+	h := http.Header{"Accept-Encoding": {"gzip"}}
+
+	// HEAD before any GET does not fill the cache.
+	w := serve(sl, "HEAD", "http://example.com/f/file.txt", h)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("HEAD: status %d with Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if c := sl.compressed; c.misses != 0 || c.hits != 0 || len(c.entries) != 0 {
+		t.Errorf("HEAD filled cache: %d misses, %d hits and %d entries", c.misses, c.hits, len(c.entries))
+	}
+
+	// Once the body is cached, HEAD is answered from it with its length.
+	get := serve(sl, "GET", "http://example.com/f/file.txt", h)
+	w = serve(sl, "HEAD", "http://example.com/f/file.txt", h)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("cached HEAD: status %d with %d bytes of body", w.Code, w.Body.Len())
+	}
+	if v, expected := w.Header().Get("Content-Length"), strconv.Itoa(get.Body.Len()); v != expected {
+		t.Errorf("cached HEAD: Content-Length %q, expected %q", v, expected)
+	}
+	if v := w.Header().Get("Etag"); v != get.Header().Get("Etag") {
+		t.Errorf("cached HEAD: ETag %q, expected %q", v, get.Header().Get("Etag"))
+	}
+	if c := sl.compressed; c.misses != 1 || c.hits != 1 || len(c.entries) != 1 {
+		t.Errorf("%d misses, %d hits and %d entries, expected 1, 1 and 1", c.misses, c.hits, len(c.entries))
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"strconv"
+	"strings"
 	"time"
 )
-import "github.com/influxdata/toml"
+import (
+	"github.com/influxdata/toml"
+	"github.com/influxdata/toml/ast"
+)
 
 type Config struct {
 	Root string
@@ -14,9 +20,13 @@ type Config struct {
 	LogLines    int
 	Development bool
 
-	HTTP    ConfigHTTP
-	HTTPS   ConfigHTTPS
-	Command ConfigCommand
+	HTTP      ConfigHTTP
+	HTTPS     ConfigHTTPS
+	Command   ConfigCommand
+	RateLimit ConfigRateLimit
+	Memory    ConfigMemory
+
+	CompressionCache ConfigCompressionCache
 }
 
 type ConfigHTTP struct {
@@ -33,16 +43,64 @@ type ConfigCommand struct {
 	Address string
 }
 
+type ConfigCompressionCache struct {
+	Disabled    bool
+	Size        ByteSize
+	MaxFileSize ByteSize
+}
+
+type ConfigMemory struct {
+	Budget      ByteSize
+	MaxFileSize ByteSize
+}
+
+type ConfigRateLimit struct {
+	Rate       Rate
+	Burst      int
+	DiskRate   Rate
+	DiskBurst  int
+	MaxClients int
+}
+
 type SiteConfig struct {
 	General     *SiteConfigGeneral
 	Cache       *SiteConfigCache
 	Compression *SiteConfigCompression
+	Headers     *SiteConfigHeaders
+	Redirects   []SiteConfigRedirect
+	Path        []SiteConfigPath
+	Mount       []SiteConfigMount
+	Auth        []SiteConfigAuth
+	Access      *SiteConfigAccess
+	RateLimit   *SiteConfigRateLimit
+	Memory      *SiteConfigMemory
+	CORS        *SiteConfigCORS
+	MIME        map[string]string
 }
 
 type SiteConfigGeneral struct {
-	NoDefaultFile bool
-	DefaultFile   string
-	FancyFolder   string
+	NoDefaultFile    bool
+	DefaultFile      string
+	Charset          string
+	SniffContentType bool
+	IndexFiles       []string
+	FancyFolder      string
+	AutoIndex        bool
+	AutoIndexSort    string
+	AutoIndexHidden  bool
+	RedirectToHTTPS  bool
+	HTTPSPort        int
+	HSTSMaxAge       int
+	SPAFallback      string
+	SPAExclude       []string
+	ServeHidden      bool
+	Ignore           []string
+	Symlinks         string
+}
+
+type SiteConfigMemory struct {
+	Budget      ByteSize
+	MaxFileSize ByteSize
 }
 
 type SiteConfigCache struct {
@@ -59,6 +117,82 @@ type SiteConfigCompression struct {
 	Blacklist          []string
 }
 
+type SiteConfigHeaders struct {
+	SecurityPreset string
+	Set            map[string]string
+	Rules          []SiteConfigHeaderRule
+}
+
+type SiteConfigHeaderRule struct {
+	Path       string
+	Extensions []string
+	Set        map[string]string
+}
+
+type SiteConfigRedirect struct {
+	From   string
+	To     string
+	Status int
+}
+
+type SiteConfigAuth struct {
+	Path  string
+	Realm string
+	File  string
+}
+
+type SiteConfigAccess struct {
+	Allow          []string
+	Deny           []string
+	TrustedProxies []string
+	Rules          []SiteConfigAccessRule
+}
+
+type SiteConfigAccessRule struct {
+	Path  string
+	Allow []string
+	Deny  []string
+}
+
+type SiteConfigRateLimit struct {
+	Rate       Rate
+	Burst      int
+	DiskRate   Rate
+	DiskBurst  int
+	MaxClients int
+}
+
+type SiteConfigCORS struct {
+	AllowOrigins     []string
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	MaxAge           int
+	AllowCredentials bool
+	Paths            []string
+}
+
+// SiteConfigPath overrides sections of the site configuration for the paths
+// it matches. Its auth section protects the paths it matches, and takes its
+// path from the match.
+type SiteConfigPath struct {
+	Match       string
+	Cache       *SiteConfigCache
+	Compression *SiteConfigCompression
+	Headers     *SiteConfigHeaders
+	Auth        *SiteConfigAuth
+}
+
+type SiteConfigMount struct {
+	Prefix          string
+	Dir             string
+	AutoIndex       bool
+	AutoIndexSort   string
+	AutoIndexHidden bool
+	Cache           *SiteConfigCache
+	Compression     *SiteConfigCompression
+}
+
 type Duration struct {
 	time.Duration
 }
@@ -69,6 +203,68 @@ func (d *Duration) UnmarshalTOML(text []byte) error {
 	return err
 }
 
+// Rate is a number of requests per second. It can be given as a plain number,
+// or as a string with a unit, such as "30/m".
+type Rate struct {
+	PerSecond float64
+}
+
+func (r *Rate) UnmarshalTOML(text []byte) error {
+	s := strings.Trim(string(text), `"'`)
+	unit := time.Second
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		switch s[i+1:] {
+		case "s":
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		default:
+			return fmt.Errorf("invalid rate unit in %q", s)
+		}
+		s = s[:i]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	r.PerSecond = n / unit.Seconds()
+	return nil
+}
+
+// ByteSize is a number of bytes. It can be given as a plain number, or as a
+// string with a unit, such as "64MB".
+type ByteSize struct {
+	Bytes int64
+}
+
+func (b *ByteSize) UnmarshalTOML(text []byte) error {
+	s := strings.ToUpper(strings.TrimSpace(strings.Trim(string(text), `"'`)))
+	unit := int64(1)
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	b.Bytes = n * unit
+	return nil
+}
+
 var (
 	threeMonths       = Duration{Duration: 90 * 24 * time.Hour}
 	oneWeek           = Duration{Duration: 7 * 24 * time.Hour}
@@ -85,7 +281,14 @@ var (
 	DefaultSiteConfig = SiteConfig{
 		General: &SiteConfigGeneral{
 			DefaultFile: "index.html",
+			IndexFiles: []string{
+				"index.html",
+				"index.htm",
+				"index.xhtml",
+			},
 			FancyFolder: "/f/",
+			Charset:     "utf-8",
+			Symlinks:    symlinksWithinRoot,
 		},
 		Cache: &SiteConfigCache{
 			CacheTimes:       DefaultCacheTimes,
@@ -100,6 +303,13 @@ var (
 			},
 			MinSize: 256,
 		},
+		Headers:   &SiteConfigHeaders{},
+		Access:    &SiteConfigAccess{},
+		RateLimit: &SiteConfigRateLimit{},
+		Memory:    &SiteConfigMemory{},
+		CORS: &SiteConfigCORS{
+			AllowMethods: []string{"GET", "HEAD"},
+		},
 	}
 	DefaultConfig = Config{
 		Root: "/srv/web",
@@ -110,25 +320,49 @@ var (
 			Address: ":65001",
 		},
 	}
+
+	DefaultCompressionCacheSize        = ByteSize{Bytes: 64 * 1024 * 1024}
+	DefaultCompressionCacheMaxFileSize = ByteSize{Bytes: 4 * 1024 * 1024}
+	DefaultMemoryMaxFileSize           = ByteSize{Bytes: 32 * 1024 * 1024}
 )
 
 func readSiteConf(p string) (*SiteConfig, error) {
 	var (
-		b    []byte
-		err  error
-		conf SiteConfig
+		b   []byte
+		err error
 	)
 
 	if b, err = ioutil.ReadFile(p); err != nil {
 		return &DefaultSiteConfig, err
 	}
 
+	// The general, cache and compression sections replace the defaults as a
+	// whole. The newer sections are decoded on top of copies of the default
+	// sections, so that they only need to list the options that differ from
+	// the defaults.
+	var (
+		headers   = *DefaultSiteConfig.Headers
+		access    = *DefaultSiteConfig.Access
+		rateLimit = *DefaultSiteConfig.RateLimit
+		memory    = *DefaultSiteConfig.Memory
+		cors      = *DefaultSiteConfig.CORS
+		conf      = SiteConfig{
+			Headers:   &headers,
+			Access:    &access,
+			RateLimit: &rateLimit,
+			Memory:    &memory,
+			CORS:      &cors,
+		}
+	)
+
 	if err := toml.Unmarshal(b, &conf); err != nil {
 		return nil, err
 	}
 
 	if conf.General == nil {
 		conf.General = DefaultSiteConfig.General
+	} else if err := conf.General.fillDefaults(b); err != nil {
+		return nil, err
 	}
 	if conf.Cache == nil {
 		conf.Cache = DefaultSiteConfig.Cache
@@ -136,10 +370,226 @@ func readSiteConf(p string) (*SiteConfig, error) {
 	if conf.Compression == nil {
 		conf.Compression = DefaultSiteConfig.Compression
 	}
+	if conf.Headers == nil {
+		conf.Headers = DefaultSiteConfig.Headers
+	}
+	if conf.Access == nil {
+		conf.Access = DefaultSiteConfig.Access
+	}
+	if conf.RateLimit == nil {
+		conf.RateLimit = DefaultSiteConfig.RateLimit
+	}
+	if conf.Memory == nil {
+		conf.Memory = DefaultSiteConfig.Memory
+	}
+	if conf.CORS == nil {
+		conf.CORS = DefaultSiteConfig.CORS
+	}
+
+	if err := conf.Headers.validate(); err != nil {
+		return nil, err
+	}
+
+	switch conf.General.Symlinks {
+	case symlinksFollow, symlinksDeny, symlinksWithinRoot:
+	default:
+		return nil, fmt.Errorf("unknown symlink mode %q", conf.General.Symlinks)
+	}
+
+	if conf.MIME, err = normalizeMIME(conf.MIME); err != nil {
+		return nil, err
+	}
+
+	for _, a := range conf.Auth {
+		if !strings.HasPrefix(a.Path, "/") {
+			return nil, fmt.Errorf("auth path %q must start with /", a.Path)
+		}
+		if a.File == "" {
+			return nil, fmt.Errorf("auth for %s without file", a.Path)
+		}
+	}
+
+	if len(conf.Path) > 0 {
+		if conf.Path, err = readPathConf(b, &conf); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(conf.Mount) > 0 {
+		if conf.Mount, err = readMountConf(b, &conf); err != nil {
+			return nil, err
+		}
+	}
 
 	return &conf, nil
 }
 
+// readPathConf decodes the path blocks of a site configuration. Their cache
+// and compression sections are decoded on top of copies of the sections of the
+// site, so they only need to list the options that differ. Sections a block
+// does not have are left nil.
+func readPathConf(b []byte, site *SiteConfig) ([]SiteConfigPath, error) {
+	tbl, err := toml.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	tables, _ := tbl.Fields["path"].([]*ast.Table)
+	paths := make([]SiteConfigPath, 0, len(tables))
+	for _, t := range tables {
+		var (
+			cache       = *site.Cache
+			compression = *site.Compression
+			p           = SiteConfigPath{
+				Cache:       &cache,
+				Compression: &compression,
+				Headers:     &SiteConfigHeaders{},
+			}
+		)
+
+		if err := toml.UnmarshalTable(t, &p); err != nil {
+			return nil, err
+		}
+		if p.Match == "" {
+			return nil, fmt.Errorf("path block without match")
+		}
+		if err := validatePattern(p.Match); err != nil {
+			return nil, err
+		}
+		if err := p.Headers.validate(); err != nil {
+			return nil, err
+		}
+		if p.Auth != nil {
+			if p.Auth.Path != "" {
+				return nil, fmt.Errorf("auth for %s must not have a path", p.Match)
+			}
+			if p.Auth.File == "" {
+				return nil, fmt.Errorf("auth for %s without file", p.Match)
+			}
+		}
+
+		if c, exists := t.Fields["cache"]; !exists {
+			p.Cache = nil
+		} else if c, ok := c.(*ast.Table); ok {
+			// A default cache time set for the block applies to all its
+			// files, rather than only to those without a cache time for
+			// their extension, unless the block sets those too.
+			_, defaultTime := c.Fields["defaultCacheTime"]
+			_, times := c.Fields["cacheTimes"]
+			if defaultTime && !times {
+				p.Cache.CacheTimes = nil
+			}
+		}
+		if _, exists := t.Fields["compression"]; !exists {
+			p.Compression = nil
+		}
+		if _, exists := t.Fields["headers"]; !exists {
+			p.Headers = nil
+		}
+
+		paths = append(paths, p)
+	}
+
+	return paths, nil
+}
+
+// readMountConf decodes the mount blocks of a site configuration. Like path
+// blocks, their cache and compression sections are decoded on top of copies of
+// the sections of the site.
+func readMountConf(b []byte, site *SiteConfig) ([]SiteConfigMount, error) {
+	tbl, err := toml.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	tables, _ := tbl.Fields["mount"].([]*ast.Table)
+	mounts := make([]SiteConfigMount, 0, len(tables))
+	for _, t := range tables {
+		var (
+			cache       = *site.Cache
+			compression = *site.Compression
+			m           = SiteConfigMount{
+				AutoIndexSort: site.General.AutoIndexSort,
+				Cache:         &cache,
+				Compression:   &compression,
+			}
+		)
+
+		if err := toml.UnmarshalTable(t, &m); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(m.Prefix, "/") {
+			return nil, fmt.Errorf("mount prefix %q must start with /", m.Prefix)
+		}
+		if !strings.HasSuffix(m.Prefix, "/") {
+			m.Prefix += "/"
+		}
+		if m.Dir == "" {
+			return nil, fmt.Errorf("mount %s without dir", m.Prefix)
+		}
+
+		mounts = append(mounts, m)
+	}
+
+	return mounts, nil
+}
+
+// forPath resolves the configuration for a resource served at sitepath. The
+// matching path blocks are applied in order, with later blocks replacing the
+// cache and compression sections of earlier ones, and headers accumulating.
+// If no blocks match, the site configuration itself is returned.
+func (c *SiteConfig) forPath(sitepath string) *SiteConfig {
+	var conf *SiteConfig
+	for i := range c.Path {
+		p := &c.Path[i]
+		if !matchPath(p.Match, sitepath) {
+			continue
+		}
+
+		if conf == nil {
+			cp := *c
+			conf = &cp
+		}
+		if p.Cache != nil {
+			conf.Cache = p.Cache
+		}
+		if p.Compression != nil {
+			conf.Compression = p.Compression
+		}
+		if p.Headers != nil {
+			conf.Headers = conf.Headers.merge(p.Headers)
+		}
+	}
+
+	if conf == nil {
+		return c
+	}
+	return conf
+}
+
+// fillDefaults sets the options of the general section that were added after
+// the section could be written without them to their defaults, if the section
+// in the configuration b does not list them. This keeps existing sections
+// working as they did.
+func (g *SiteConfigGeneral) fillDefaults(b []byte) error {
+	tbl, err := toml.Parse(b)
+	if err != nil {
+		return err
+	}
+	t, _ := tbl.Fields["general"].(*ast.Table)
+	if t == nil {
+		return nil
+	}
+
+	if _, exists := t.Fields["charset"]; !exists {
+		g.Charset = DefaultSiteConfig.General.Charset
+	}
+	if _, exists := t.Fields["symlinks"]; !exists {
+		g.Symlinks = DefaultSiteConfig.General.Symlinks
+	}
+	return nil
+}
+
 func readServerConf(p string) (*Config, error) {
 	var (
 		b    []byte
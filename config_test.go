@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSiteConf(t *testing.T) {
+	tests := []struct {
+		config string
+		check  func(*SiteConfig) bool
+		name   string
+	}{
+		{"", func(c *SiteConfig) bool {
+			return c.General == DefaultSiteConfig.General && c.Cache == DefaultSiteConfig.Cache && c.Compression == DefaultSiteConfig.Compression
+		}, "missing sections are the defaults"},
+		{"[general]\nautoIndex = true\n", func(c *SiteConfig) bool {
+			return c.General.DefaultFile == "" && c.General.FancyFolder == "" && len(c.General.IndexFiles) == 0
+		}, "the general section replaces the defaults"},
+		{"[general]\nautoIndex = true\n", func(c *SiteConfig) bool {
+			return c.General.Charset == "utf-8" && c.General.Symlinks == symlinksWithinRoot
+		}, "newer general options default when left out"},
+		{"[general]\ncharset = \"\"\n", func(c *SiteConfig) bool {
+			return c.General.Charset == ""
+		}, "newer general options can be cleared"},
+		{"[compression]\nminSize = 10\n", func(c *SiteConfig) bool {
+			return len(c.Compression.Blacklist) == 0
+		}, "the compression section replaces the defaults"},
+		{"[cache]\nnoCacheFromDisk = true\n", func(c *SiteConfig) bool {
+			return len(c.Cache.CacheTimes) == 0 && c.Cache.DefaultCacheTime.Duration == 0
+		}, "the cache section replaces the defaults"},
+		{"[cors]\nallowOrigins = [\"*\"]\n", func(c *SiteConfig) bool {
+			return len(c.CORS.AllowMethods) == 2
+		}, "newer sections are decoded on top of the defaults"},
+	}
+
+	for _, tt := range tests {
+		p := filepath.Join(t.TempDir(), "config.toml")
+		if err := os.WriteFile(p, []byte(tt.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		conf, err := readSiteConf(p)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(conf) {
+			t.Errorf("%s: unexpected configuration for %q", tt.name, tt.config)
+		}
+	}
+}
+
+func TestHTTPPathCache(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[[path]]
+match = "/assets/"
+[path.cache]
+defaultCacheTime = "8760h"
+
+[[path]]
+match = "/fonts/"
+[path.cache]
+defaultCacheTime = "8760h"
+cacheTimes = { ".css" = "1h" }
+`,
+		"example.com/common/index.html":       "hello",
+		"example.com/common/a.css":            "a {}",
+		"example.com/common/assets/a.css":     "a {}",
+		"example.com/common/assets/a.js":      "a()",
+		"example.com/common/fonts/a.css":      "a {}",
+		"example.com/common/fonts/a.woff":     "font",
+		"example.com/common/unmatched/a.html": "unmatched",
+	})
+
+	tests := []struct {
+		target string
+		cache  string
+	}{
+		// The site keeps its cache times.
+		{"/a.css", "public, max-age=604800"},
+		{"/unmatched/a.html", "public, max-age=3600"},
+
+		// A default cache time of a path block applies to all its files.
+		{"/assets/a.css", "public, max-age=31536000"},
+		{"/assets/a.js", "public, max-age=31536000"},
+
+		// Unless the block has cache times of its own.
+		{"/fonts/a.css", "public, max-age=3600"},
+		{"/fonts/a.woff", "public, max-age=31536000"},
+	}
+
+	for _, tt := range tests {
+		w := serve(sl, "GET", "http://example.com"+tt.target, nil)
+		if v := w.Header().Get("Cache-Control"); w.Code != http.StatusOK || v != tt.cache {
+			t.Errorf("%s: status %d with Cache-Control %q, expected %q", tt.target, w.Code, v, tt.cache)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy is the compiled CORS section of a site configuration.
+type corsPolicy struct {
+	// origins holds the permitted origins, which may contain wildcards as
+	// per path.Match. anyOrigin is set if "*" was listed.
+	origins   []string
+	anyOrigin bool
+
+	// paths restricts the policy to the matching paths, if set.
+	paths []string
+
+	methods     []string
+	headers     []string
+	anyHeader   bool
+	expose      string
+	maxAge      string
+	credentials bool
+}
+
+// newCORSPolicy compiles the CORS section of a site configuration. If no
+// origins are permitted, nil is returned.
+func newCORSPolicy(conf *SiteConfigCORS) (*corsPolicy, error) {
+	if len(conf.AllowOrigins) == 0 {
+		return nil, nil
+	}
+
+	c := &corsPolicy{
+		paths:       conf.Paths,
+		expose:      strings.Join(conf.ExposeHeaders, ", "),
+		credentials: conf.AllowCredentials,
+	}
+
+	for _, o := range conf.AllowOrigins {
+		if o == "*" {
+			c.anyOrigin = true
+			continue
+		}
+		if _, err := path.Match(o, ""); err != nil {
+			return nil, fmt.Errorf("origin %q: %v", o, err)
+		}
+		c.origins = append(c.origins, strings.ToLower(o))
+	}
+
+	for _, p := range conf.Paths {
+		if err := validatePattern(p); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, m := range conf.AllowMethods {
+		c.methods = append(c.methods, strings.ToUpper(m))
+	}
+
+	for _, hdr := range conf.AllowHeaders {
+		if hdr == "*" {
+			c.anyHeader = true
+			continue
+		}
+		c.headers = append(c.headers, http.CanonicalHeaderKey(hdr))
+	}
+
+	if conf.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(conf.MaxAge)
+	}
+
+	return c, nil
+}
+
+// matches reports whether the policy applies to the cleaned path p.
+func (c *corsPolicy) matches(p string) bool {
+	if len(c.paths) == 0 {
+		return true
+	}
+	for _, pattern := range c.paths {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// varies reports whether responses for p depend on the Origin of the request.
+// That is not the case if every origin gets the same wildcard.
+func (c *corsPolicy) varies(p string) bool {
+	return c.matches(p) && (!c.anyOrigin || c.credentials)
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for a request from
+// origin for p, or the empty string if the origin is not permitted. The
+// wildcard cannot be used with credentials, so the origin is echoed instead.
+func (c *corsPolicy) allowOrigin(origin, p string) string {
+	if origin == "" || !c.matches(p) {
+		return ""
+	}
+	if c.anyOrigin {
+		if c.credentials {
+			return origin
+		}
+		return "*"
+	}
+
+	lower := strings.ToLower(origin)
+	for _, pattern := range c.origins {
+		if matched, _ := path.Match(pattern, lower); matched {
+			return origin
+		}
+	}
+	return ""
+}
+
+// allowsMethod reports whether a preflight for method is permitted.
+func (c *corsPolicy) allowsMethod(method string) bool {
+	for _, m := range c.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether a preflight for the comma-separated list of
+// headers is permitted.
+func (c *corsPolicy) allowsHeaders(list string) bool {
+	if c.anyHeader {
+		return true
+	}
+	for _, hdr := range strings.Split(list, ",") {
+		hdr = http.CanonicalHeaderKey(strings.TrimSpace(hdr))
+		if hdr == "" {
+			continue
+		}
+		found := false
+		for _, allowed := range c.headers {
+			if allowed == hdr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// apply sets the CORS headers of a response to an actual request for p.
+func (c *corsPolicy) apply(h, reqHeader http.Header, p string) {
+	origin, _ := quickHeaderGet("Origin", reqHeader)
+	allow := c.allowOrigin(origin, p)
+	if allow == "" {
+		return
+	}
+
+	h["Access-Control-Allow-Origin"] = []string{allow}
+	if c.credentials {
+		h["Access-Control-Allow-Credentials"] = []string{"true"}
+	}
+	if c.expose != "" {
+		h["Access-Control-Expose-Headers"] = []string{c.expose}
+	}
+}
+
+// preflight sets the headers of the response to a preflight request for p. If
+// the request is not permitted, no Access-Control headers are set, which the
+// browser takes as a refusal.
+func (c *corsPolicy) preflight(h, reqHeader http.Header, p string) {
+	h["Vary"] = []string{"Origin, Access-Control-Request-Method, Access-Control-Request-Headers"}
+
+	origin, _ := quickHeaderGet("Origin", reqHeader)
+	method, _ := quickHeaderGet("Access-Control-Request-Method", reqHeader)
+	requested, _ := quickHeaderGet("Access-Control-Request-Headers", reqHeader)
+
+	allow := c.allowOrigin(origin, p)
+	if allow == "" || !c.allowsMethod(method) || !c.allowsHeaders(requested) {
+		return
+	}
+
+	h["Access-Control-Allow-Origin"] = []string{allow}
+	h["Access-Control-Allow-Methods"] = []string{strings.Join(c.methods, ", ")}
+	if requested != "" {
+		if c.anyHeader {
+			h["Access-Control-Allow-Headers"] = []string{requested}
+		} else {
+			h["Access-Control-Allow-Headers"] = []string{strings.Join(c.headers, ", ")}
+		}
+	}
+	if c.maxAge != "" {
+		h["Access-Control-Max-Age"] = []string{c.maxAge}
+	}
+	if c.credentials {
+		h["Access-Control-Allow-Credentials"] = []string{"true"}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPCORSPreflight(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[cors]
+allowOrigins = ["https://app.example.net", "https://*.example.org"]
+allowMethods = ["get", "HEAD"]
+allowHeaders = ["x-token"]
+maxAge = 600
+paths = ["/api/", "*.json"]
+`,
+		"example.com/common/api/index.html": "api",
+		"example.com/common/data.json":      "{}",
+		"example.com/common/index.html":     "hello",
+	})
+
+	tests := []struct {
+		origin  string
+		target  string
+		method  string
+		headers string
+		allowed bool
+	}{
+		{"https://app.example.net", "http://example.com/api/", "GET", "", true},
+		{"https://APP.example.net", "http://example.com/api/", "GET", "", true},
+		{"https://www.example.org", "http://example.com/data.json", "HEAD", "X-Token", true},
+		{"https://app.example.net", "http://example.com/api/", "GET", "x-token, X-TOKEN", true},
+
+		// Disallowed origins, methods, headers and paths.
+		{"https://evil.example.com", "http://example.com/api/", "GET", "", false},
+		{"https://example.org", "http://example.com/api/", "GET", "", false},
+		{"https://app.example.net", "http://example.com/api/", "PUT", "", false},
+		{"https://app.example.net", "http://example.com/api/", "GET", "X-Token, X-Other", false},
+		{"https://app.example.net", "http://example.com/", "GET", "", false},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{
+			"Origin":                        {tt.origin},
+			"Access-Control-Request-Method": {tt.method},
+		}
+		if tt.headers != "" {
+			h["Access-Control-Request-Headers"] = []string{tt.headers}
+		}
+
+		// Preflights are answered without a resource, so a 204 is expected
+		// whether or not the request is allowed.
+		w := serve(sl, "OPTIONS", tt.target, h)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("preflight from %s for %s: status %d, expected %d", tt.origin, tt.target, w.Code, http.StatusNoContent)
+			continue
+		}
+
+		rh := w.Header()
+		if v := rh.Get("Vary"); !strings.Contains(v, "Origin") {
+			t.Errorf("preflight from %s for %s: Vary %q lacks Origin", tt.origin, tt.target, v)
+		}
+
+		if !tt.allowed {
+			for k := range rh {
+				if strings.HasPrefix(k, "Access-Control-") {
+					t.Errorf("refused preflight from %s for %s: unexpected %s", tt.origin, tt.target, k)
+				}
+			}
+			continue
+		}
+
+		expected := map[string]string{
+			"Access-Control-Allow-Origin":  tt.origin,
+			"Access-Control-Allow-Methods": "GET, HEAD",
+			"Access-Control-Max-Age":       "600",
+		}
+		if tt.headers != "" {
+			expected["Access-Control-Allow-Headers"] = "X-Token"
+		}
+		for k, v := range expected {
+			if rh.Get(k) != v {
+				t.Errorf("preflight from %s for %s: %s %q, expected %q", tt.origin, tt.target, k, rh.Get(k), v)
+			}
+		}
+	}
+
+	// OPTIONS without Access-Control-Request-Method is not a preflight.
+	if w := serve(sl, "OPTIONS", "http://example.com/api/", http.Header{"Origin": {"https://app.example.net"}}); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("OPTIONS without request method: status %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHTTPCORSResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		origin string
+		target string
+		allow  string
+		vary   bool
+	}{
+		{"listed", `allowOrigins = ["https://app.example.net"]`, "https://app.example.net", "/", "https://app.example.net", true},
+		{"disallowed", `allowOrigins = ["https://app.example.net"]`, "https://evil.example.com", "/", "", true},
+		{"no origin", `allowOrigins = ["https://app.example.net"]`, "", "/", "", true},
+		{"other path", `allowOrigins = ["https://app.example.net"]
+paths = ["/api/"]`, "https://app.example.net", "/", "", false},
+		{"any", `allowOrigins = ["*"]`, "https://evil.example.com", "/", "*", false},
+		{"any with credentials", `allowOrigins = ["*"]
+allowCredentials = true`, "https://evil.example.com", "/", "https://evil.example.com", true},
+	}
+
+	for _, tt := range tests {
+		sl := newTestSitelist(t, map[string]string{
+			"example.com/config.toml":       "[cors]\n" + tt.config + "\n",
+			"example.com/common/index.html": "hello",
+		})
+
+		var h http.Header
+		if tt.origin != "" {
+			h = http.Header{"Origin": {tt.origin}}
+		}
+		w := serve(sl, "GET", "http://example.com"+tt.target, h)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d, expected %d", tt.name, w.Code, http.StatusOK)
+			continue
+		}
+
+		rh := w.Header()
+		if v := rh.Get("Access-Control-Allow-Origin"); v != tt.allow {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, expected %q", tt.name, v, tt.allow)
+		}
+		if vary := strings.Contains(rh.Get("Vary"), "Origin"); vary != tt.vary {
+			t.Errorf("%s: Vary %q, expected Origin %v", tt.name, rh.Get("Vary"), tt.vary)
+		}
+		if !strings.Contains(rh.Get("Vary"), "Accept-Encoding") {
+			t.Errorf("%s: Vary %q lacks Accept-Encoding", tt.name, rh.Get("Vary"))
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+import (
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoding describes a content-coding the server can produce.
+type encoding struct {
+	// name is the content-coding token, as used in Accept-Encoding and
+	// Content-Encoding.
+	name string
+
+	// ext is the file extension of precompressed sidecar files.
+	ext string
+
+	// compress produces the precompressed variant of a memory resource.
+	compress func([]byte) []byte
+
+	// writer wraps an io.Writer in a streaming encoder for from-disk
+	// resources. It is nil if the encoding is not used for streaming.
+	writer func(io.Writer) io.WriteCloser
+}
+
+// variant is an encoded representation of a resource.
+type variant struct {
+	encoding *encoding
+	body     []byte
+	hash     string
+
+	// path and size locate the precompressed sidecar file the variant came
+	// from, if any. Variants of from-disk resources are streamed from it.
+	path string
+	size int64
+}
+
+var (
+	encodingBrotli = &encoding{
+		name:     "br",
+		ext:      ".br",
+		compress: br,
+	}
+	encodingZstd = &encoding{
+		name:     "zstd",
+		ext:      ".zst",
+		compress: zst,
+		writer: func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		},
+	}
+	encodingGZIP = &encoding{
+		name:     "gzip",
+		ext:      ".gz",
+		compress: gz,
+		writer: func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		},
+	}
+
+	// encodings lists the supported content-codings in order of server
+	// preference.
+	encodings = []*encoding{
+		encodingBrotli,
+		encodingZstd,
+		encodingGZIP,
+	}
+)
+
+func gz(b []byte) []byte {
+	buf := new(bytes.Buffer)
+	gz, _ := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	gz.Write(b)
+	gz.Close()
+	return buf.Bytes()
+}
+
+// Files larger than brotliLargeSize are compressed with brotli at
+// brotliLargeLevel rather than the best compression, which only manages around
+// a megabyte per second. Files are compressed on every reload, and in
+// development mode, that means on every request.
+const (
+	brotliLargeSize  = 1024 * 1024
+	brotliLargeLevel = 6
+)
+
+func br(b []byte) []byte {
+	level := brotli.BestCompression
+	if len(b) > brotliLargeSize {
+		level = brotliLargeLevel
+	}
+
+	buf := new(bytes.Buffer)
+	br := brotli.NewWriterLevel(buf, level)
+	br.Write(b)
+	br.Close()
+	return buf.Bytes()
+}
+
+// zstdEncoder is shared by all calls to zst, as EncodeAll is safe for
+// concurrent use.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+
+func zst(b []byte) []byte {
+	return zstdEncoder.EncodeAll(b, nil)
+}
+
+// sidecarOf returns the path of the file that the file at p is a precompressed
+// sidecar of. If p is not a sidecar, or the file it belongs to does not exist,
+// the empty string is returned.
+func sidecarOf(p string) string {
+	for _, e := range encodings {
+		if !strings.HasSuffix(p, e.ext) {
+			continue
+		}
+		base := strings.TrimSuffix(p, e.ext)
+		if fi, err := os.Stat(base); err == nil && !fi.IsDir() {
+			return base
+		}
+	}
+	return ""
+}
+
+// isSidecar reports whether name is a precompressed sidecar file of one of the
+// files in a directory, as listed in files.
+func isSidecar(name string, files map[string]bool) bool {
+	for _, e := range encodings {
+		if strings.HasSuffix(name, e.ext) && files[strings.TrimSuffix(name, e.ext)] {
+			return true
+		}
+	}
+	return false
+}
+
+// findSidecars looks for precompressed sidecar files next to the file at p,
+// which has the os.FileInfo fi. Sidecars older than the file are ignored, as
+// they are likely stale, and so are those keep returns false for, given their
+// extension. The variants carry no body.
+func findSidecars(p string, fi os.FileInfo, keep func(string) bool) map[*encoding]*variant {
+	var sidecars map[*encoding]*variant
+	for _, e := range encodings {
+		sfi, err := os.Stat(p + e.ext)
+		if err != nil || sfi.IsDir() || sfi.ModTime().Before(fi.ModTime()) || !keep(e.ext) {
+			continue
+		}
+		if sidecars == nil {
+			sidecars = make(map[*encoding]*variant)
+		}
+		sidecars[e] = &variant{
+			encoding: e,
+			hash:     fmt.Sprintf("W/\"%x-%x-%s\"", sfi.ModTime().Unix(), sfi.Size(), e.name),
+			path:     p + e.ext,
+			size:     sfi.Size(),
+		}
+	}
+	return sidecars
+}
+
+// readSidecars reads the precompressed sidecar files of the file at p, as
+// found by findSidecars. Sidecars that cannot be read are skipped.
+func readSidecars(p string, fi os.FileInfo, keep func(string) bool) map[*encoding]*variant {
+	sidecars := findSidecars(p, fi, keep)
+	for e, v := range sidecars {
+		body, err := ioutil.ReadFile(v.path)
+		if err != nil {
+			delete(sidecars, e)
+			continue
+		}
+		v.body = body
+		v.hash = hash(body)
+	}
+	return sidecars
+}
+
+// encodeAll produces a variant of b for every supported encoding. Encodings
+// with a precompressed variant are not compressed again, and the others are
+// only compressed if compress is set.
+func encodeAll(b []byte, precompressed map[*encoding]*variant, compress bool) []*variant {
+	variants := make([]*variant, 0, len(encodings))
+	for _, e := range encodings {
+		if v, exists := precompressed[e]; exists {
+			variants = append(variants, v)
+			continue
+		}
+		if !compress {
+			continue
+		}
+		body := e.compress(b)
+		variants = append(variants, &variant{
+			encoding: e,
+			body:     body,
+			hash:     hash(body),
+		})
+	}
+	return variants
+}
+
+// streamVariants produces a variant for every encoding that can be used for
+// streaming the file at p, which has the os.FileInfo fi. Precompressed sidecar
+// files are used where available, and otherwise the file is encoded on the
+// fly. The variants carry no body, only a weak entity tag.
+func streamVariants(p string, fi os.FileInfo, keep func(string) bool) []*variant {
+	var (
+		variants []*variant
+		sidecars = findSidecars(p, fi, keep)
+	)
+	for _, e := range encodings {
+		if v, exists := sidecars[e]; exists {
+			variants = append(variants, v)
+			continue
+		}
+		if e.writer == nil {
+			continue
+		}
+		variants = append(variants, &variant{
+			encoding: e,
+			hash:     fmt.Sprintf("W/\"%x-%x-%s\"", fi.ModTime().Unix(), fi.Size(), e.name),
+		})
+	}
+	return variants
+}
+
+// withoutSidecars returns the variants that do not come from precompressed
+// sidecar files.
+func withoutSidecars(variants []*variant) []*variant {
+	var l []*variant
+	for _, v := range variants {
+		if v.path == "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// encodeStream produces a variant of b for every encoding that can be used for
+// streaming. It is used for small bodies generated on request, where the
+// precompression levels would be too slow.
+func encodeStream(b []byte) []*variant {
+	var variants []*variant
+	for _, e := range encodings {
+		if e.writer == nil {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		ew := e.writer(buf)
+		ew.Write(b)
+		ew.Close()
+		variants = append(variants, &variant{
+			encoding: e,
+			body:     buf.Bytes(),
+			hash:     hash(buf.Bytes()),
+		})
+	}
+	return variants
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPSidecars(t *testing.T) {
+	var (
+		plain = strings.Repeat("console.log('hello');\n", 64)
+		files = map[string]string{
+			"example.com/config.toml": `
+[general]
+fancyFolder = "/f/"
+autoIndex = true
+`,
+			"example.com/common/index.html":      "hello",
+			"example.com/common/app.js":          plain,
+			"example.com/common/app.js.br":       "br sidecar",
+			"example.com/common/app.js.gz":       "gzip sidecar",
+			"example.com/common/archive.tar.gz":  "archive",
+			"example.com/fancy/f/app.js":         plain,
+			"example.com/fancy/f/app.js.br":      "br sidecar",
+			"example.com/fancy/f/app.js.gz":      "gzip sidecar",
+			"example.com/fancy/f/archive.tar.gz": "archive",
+		}
+		sl = newTestSitelist(t, files)
+	)
+
+	tests := []struct {
+		target   string
+		accept   string
+		status   int
+		encoding string
+		body     string
+	}{
+		{"/app.js", "br, gzip", http.StatusOK, "br", "br sidecar"},
+		{"/app.js", "gzip", http.StatusOK, "gzip", "gzip sidecar"},
+		{"/app.js", "", http.StatusOK, "", plain},
+		{"/app.js", "br;q=0.5, gzip", http.StatusOK, "gzip", "gzip sidecar"},
+		{"/app.js.br", "", http.StatusNotFound, "", ""},
+		{"/app.js.gz", "gzip", http.StatusNotFound, "", ""},
+		{"/archive.tar.gz", "", http.StatusOK, "", "archive"},
+
+		{"/f/app.js", "br, gzip", http.StatusOK, "br", "br sidecar"},
+		{"/f/app.js", "gzip", http.StatusOK, "gzip", "gzip sidecar"},
+		{"/f/app.js", "", http.StatusOK, "", plain},
+		{"/f/app.js.br", "", http.StatusNotFound, "", ""},
+		{"/f/archive.tar.gz", "", http.StatusOK, "", "archive"},
+	}
+
+	for _, tt := range tests {
+		var h http.Header
+		if tt.accept != "" {
+			h = http.Header{"Accept-Encoding": {tt.accept}}
+		}
+		w := serve(sl, "GET", "http://example.com"+tt.target, h)
+		if w.Code != tt.status {
+			t.Errorf("%s with %q: status %d, expected %d", tt.target, tt.accept, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if v := w.Header().Get("Content-Encoding"); v != tt.encoding {
+			t.Errorf("%s with %q: Content-Encoding %q, expected %q", tt.target, tt.accept, v, tt.encoding)
+		}
+		if body := w.Body.String(); body != tt.body {
+			t.Errorf("%s with %q: body %q, expected %q", tt.target, tt.accept, body, tt.body)
+		}
+	}
+
+	// Sidecars are left out of directory listings.
+	w := serve(sl, "GET", "http://example.com/f/", nil)
+	if body := w.Body.String(); !strings.Contains(body, "app.js") || !strings.Contains(body, "archive.tar.gz") || strings.Contains(body, "app.js.br") || strings.Contains(body, "app.js.gz") {
+		t.Errorf("listing of /f/: %q", body)
+	}
+
+	// Sidecars older than their file are stale, and not used.
+	for _, name := range []string{"common/app.js.br", "fancy/f/app.js.br"} {
+		p := filepath.Join(sl.root, "example.com", filepath.FromSlash(name))
+		stale := testModTime.Add(-1)
+		if err := os.Chtimes(p, stale, stale); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sl.load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/app.js", "/f/app.js"} {
+		w := serve(sl, "GET", "http://example.com"+target, http.Header{"Accept-Encoding": {"br"}})
+		if w.Body.String() == "br sidecar" {
+			t.Errorf("%s: stale sidecar served", target)
+		}
+	}
+}
+
+func TestHTTPSidecarsFiltered(t *testing.T) {
+	plain := strings.Repeat("console.log('hello');\n", 64)
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[general]
+fancyFolder = "/f/"
+ignore = ["*.gz"]
+`,
+		"example.com/common/index.html": "hello",
+		"example.com/common/app.js":     plain,
+		"example.com/common/app.js.gz":  "ignored sidecar",
+		"example.com/fancy/f/app.js":    plain,
+		"example.com/fancy/f/app.js.gz": "ignored sidecar",
+	})
+
+	// Sidecars pointing outside of the site are not used either.
+	outside := outsideFile(t, "outside sidecar")
+	if err := os.Chtimes(outside, testModTime, testModTime); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, sl, outside, "example.com/common/app.js.br")
+	symlink(t, sl, outside, "example.com/fancy/f/app.js.br")
+	if err := sl.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/app.js", "/f/app.js"} {
+		for _, accept := range []string{"br", "gzip"} {
+			w := serve(sl, "GET", "http://example.com"+target, http.Header{"Accept-Encoding": {accept}})
+			if body := w.Body.String(); w.Code != http.StatusOK || strings.Contains(body, "sidecar") {
+				t.Errorf("%s with %s: status %d with body %q", target, accept, w.Code, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink modes, as per the symlinks option of the site configuration.
+const (
+	symlinksFollow     = "follow"
+	symlinksDeny       = "deny"
+	symlinksWithinRoot = "within-root"
+)
+
+// ignoreFile is the name of the file in the site directory listing the paths
+// that must not be served.
+const ignoreFile = ".minihttpignore"
+
+// fileFilter decides which files of a site may be served, whether from memory
+// or from disk.
+type fileFilter struct {
+	hidden   bool
+	ignore   []string
+	symlinks string
+}
+
+// readIgnore reads an ignore file. Blank lines and lines starting with # are
+// skipped. A missing file is not an error.
+func readIgnore(p string) ([]string, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// loadFilter sets up the file filter of the site from its configuration and
+// ignore file. Invalid patterns are skipped and returned as errors.
+func (s *site) loadFilter() []error {
+	var errs []error
+
+	patterns, err := readIgnore(path.Join(s.dir, ignoreFile))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	patterns = append(patterns, s.config.General.Ignore...)
+
+	s.filter = &fileFilter{
+		hidden:   s.config.General.ServeHidden,
+		symlinks: s.config.General.Symlinks,
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(strings.Trim(pattern, "/"), ""); err != nil {
+			errs = append(errs, fmt.Errorf("ignore pattern %q: %v", pattern, err))
+			continue
+		}
+		s.filter.ignore = append(s.filter.ignore, pattern)
+	}
+
+	return errs
+}
+
+// ignored reports whether the path p, as served on the site, matches an ignore
+// pattern. Patterns starting with a slash are matched against the full path
+// as per matchPath. Other patterns are matched against every element of the
+// path, and only against directories if they end in a slash.
+func (f *fileFilter) ignored(p string) bool {
+	elems := strings.Split(strings.Trim(p, "/"), "/")
+	dirs := elems
+	if !strings.HasSuffix(p, "/") {
+		dirs = elems[:len(elems)-1]
+	}
+
+	for _, pattern := range f.ignore {
+		if strings.HasPrefix(pattern, "/") {
+			if matchPath(pattern, p) {
+				return true
+			}
+			continue
+		}
+
+		candidates := elems
+		if strings.HasSuffix(pattern, "/") {
+			candidates = dirs
+		}
+		name := strings.TrimSuffix(pattern, "/")
+		for _, elem := range candidates {
+			if matched, _ := path.Match(name, elem); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isHidden reports whether the path p, as served on the site, has an element
+// starting with a dot. .well-known is not considered hidden, as it exists to
+// be served.
+func isHidden(p string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if strings.HasPrefix(elem, ".") && elem != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSymlinks verifies the path diskpath below root against the symlink
+// mode of the filter.
+func (f *fileFilter) checkSymlinks(root, diskpath string) error {
+	switch f.symlinks {
+	case symlinksDeny:
+		rel, err := filepath.Rel(root, diskpath)
+		if err != nil {
+			return err
+		}
+		p := root
+		for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+			if elem == "." {
+				continue
+			}
+			p = filepath.Join(p, elem)
+			fi, err := os.Lstat(p)
+			if err != nil {
+				return err
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("%s is a symlink", p)
+			}
+		}
+	case symlinksWithinRoot:
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return err
+		}
+		resolved, err := filepath.EvalSymlinks(diskpath)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(resolvedRoot, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			return fmt.Errorf("%s points outside of %s", diskpath, root)
+		}
+	}
+	return nil
+}
+
+// keepSidecar returns a function reporting whether the precompressed sidecar
+// with a given extension of the file at diskpath below root, served at the path
+// p, may be used. Sidecars are checked as if they were served on their own, so
+// that they cannot be used to get around the filter.
+func (f *fileFilter) keepSidecar(root, diskpath, p string) func(string) bool {
+	if strings.HasSuffix(p, "/") {
+		p += path.Base(diskpath)
+	}
+	return func(ext string) bool {
+		return f.excluded(root, diskpath+ext, p+ext) == ""
+	}
+}
+
+// excluded returns the reason the file at diskpath below root, served at the
+// path p, must not be served. If it may be served, the empty string is
+// returned.
+func (f *fileFilter) excluded(root, diskpath, p string) string {
+	if !f.hidden && isHidden(p) {
+		return "hidden"
+	}
+	if f.ignored(p) {
+		return "ignored"
+	}
+	if err := f.checkSymlinks(root, diskpath); err != nil {
+		return err.Error()
+	}
+	return ""
+}
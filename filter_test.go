@@ -0,0 +1,279 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileFilterIgnored(t *testing.T) {
+	f := &fileFilter{
+		ignore: []string{"/drafts/", "/secret.html", "*.swp", "node_modules/", "*~"},
+	}
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{"/index.html", false},
+		{"/drafts/", true},
+		{"/drafts/post.html", true},
+		{"/blog/drafts/post.html", false},
+		{"/secret.html", true},
+		{"/a/secret.html", false},
+		{"/a/.index.html.swp", true},
+		{"/a/index.html~", true},
+		{"/node_modules/", true},
+		{"/a/node_modules/x.js", true},
+		{"/node_modules", false},
+	}
+
+	for _, tt := range tests {
+		if ignored := f.ignored(tt.path); ignored != tt.ignored {
+			t.Errorf("ignored(%q) = %v, expected %v", tt.path, ignored, tt.ignored)
+		}
+	}
+}
+
+func TestIsHidden(t *testing.T) {
+	tests := []struct {
+		path   string
+		hidden bool
+	}{
+		{"/index.html", false},
+		{"/.env", true},
+		{"/.git/config", true},
+		{"/a/.b/c", true},
+		{"/.well-known/acme-challenge/x", false},
+		{"/a.b/c", false},
+	}
+
+	for _, tt := range tests {
+		if hidden := isHidden(tt.path); hidden != tt.hidden {
+			t.Errorf("isHidden(%q) = %v, expected %v", tt.path, hidden, tt.hidden)
+		}
+	}
+}
+
+// symlink creates a symlink at the slash-separated path name below the root
+// of the sitelist.
+func symlink(t *testing.T, sl *sitelist, target, name string) {
+	t.Helper()
+	p := filepath.Join(sl.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// outsideFile writes a file outside of any site, returning its path.
+func outsideFile(t *testing.T, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "outside.txt")
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHTTPFileFilter(t *testing.T) {
+	for _, base := range []string{"", "/f", "/dl"} {
+		// The same files are served from memory, the from-disk folder and a
+		// mount, so that the filter is checked for each.
+		var dir string
+		switch base {
+		case "":
+			dir = "example.com/common"
+		case "/f":
+			dir = "example.com/fancy/f"
+		case "/dl":
+			dir = "example.com/releases"
+		}
+
+		sl := newTestSitelist(t, map[string]string{
+			"example.com/config.toml": `
+[general]
+fancyFolder = "/f/"
+autoIndex = true
+ignore = ["*.swp"]
+
+[[mount]]
+prefix = "/dl/"
+dir = "releases"
+autoIndex = true
+`,
+			"example.com/.minihttpignore":          "/drafts/\n",
+			"example.com/common/index.html":        "hello",
+			"example.com/common/drafts/post.txt":   "draft",
+			dir + "/file.txt":                      "file",
+			dir + "/.env":                          "secret",
+			dir + "/.well-known/security.txt":      "contact",
+			dir + "/file.txt.swp":                  "swap",
+			dir + "/sub/inside.txt":                "inside",
+			"example.com/fancy/f/placeholder.txt":  "",
+			"example.com/releases/placeholder.txt": "",
+		})
+
+		symlink(t, sl, "file.txt", dir+"/link.txt")
+		symlink(t, sl, outsideFile(t, "outside"), dir+"/outside.txt")
+		if err := sl.load(); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			target string
+			status int
+			body   string
+		}{
+			{"/file.txt", http.StatusOK, "file"},
+			{"/.env", http.StatusNotFound, ""},
+			{"/.well-known/security.txt", http.StatusOK, "contact"},
+			{"/file.txt.swp", http.StatusNotFound, ""},
+			{"/sub/inside.txt", http.StatusOK, "inside"},
+			{"/link.txt", http.StatusOK, "file"},
+			{"/outside.txt", http.StatusNotFound, ""},
+		}
+
+		for _, tt := range tests {
+			target := base + tt.target
+			w := serve(sl, "GET", "http://example.com"+target, nil)
+			if w.Code != tt.status {
+				t.Errorf("%s: status %d, expected %d", target, w.Code, tt.status)
+				continue
+			}
+			if tt.status == http.StatusOK && w.Body.String() != tt.body {
+				t.Errorf("%s: body %q, expected %q", target, w.Body.String(), tt.body)
+			}
+		}
+
+		if base == "" {
+			// The ignore file of the site applies too.
+			if w := serve(sl, "GET", "http://example.com/drafts/post.txt", nil); w.Code != http.StatusNotFound {
+				t.Errorf("/drafts/post.txt: status %d, expected %d", w.Code, http.StatusNotFound)
+			}
+
+			// Files excluded while loading are reported.
+			var reported int
+			for _, d := range sl.diagnostics {
+				if strings.Contains(d, "excluded") {
+					reported++
+				}
+			}
+			if reported < 4 {
+				t.Errorf("%d exclusions reported, expected at least 4: %q", reported, sl.diagnostics)
+			}
+			continue
+		}
+
+		// Excluded files are left out of directory listings.
+		w := serve(sl, "GET", "http://example.com"+base+"/", nil)
+		body := w.Body.String()
+		for _, name := range []string{"file.txt", "link.txt", "sub/"} {
+			if !strings.Contains(body, name) {
+				t.Errorf("listing of %s/ lacks %s", base, name)
+			}
+		}
+		for _, name := range []string{".env", "file.txt.swp", "outside.txt"} {
+			if strings.Contains(body, name) {
+				t.Errorf("listing of %s/ has %s", base, name)
+			}
+		}
+	}
+}
+
+func TestHTTPFileFilterIndex(t *testing.T) {
+	for _, base := range []string{"", "/f"} {
+		// Directory index files are filtered like any other file, both when
+		// loaded into memory and when served from disk. An excluded index
+		// file is treated as absent, so the next one is used instead.
+		dir := "example.com/common"
+		if base == "/f" {
+			dir = "example.com/fancy/f"
+		}
+
+		sl := newTestSitelist(t, map[string]string{
+			"example.com/config.toml": `
+[general]
+defaultFile = "index.html"
+indexFiles = ["index.htm"]
+fancyFolder = "/f/"
+ignore = ["/fallback/index.html", "/f/fallback/index.html"]
+`,
+			"example.com/common/index.html": "hello",
+			dir + "/fallback/index.html":    "ignored",
+			dir + "/fallback/index.htm":     "fallback",
+		})
+		symlink(t, sl, outsideFile(t, "outside"), dir+"/docs/index.html")
+		if err := sl.load(); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			target string
+			status int
+			body   string
+		}{
+			{"/docs/", http.StatusNotFound, ""},
+			{"/docs/index.html", http.StatusNotFound, ""},
+			{"/fallback/", http.StatusOK, "fallback"},
+			{"/fallback/index.html", http.StatusNotFound, ""},
+		}
+
+		for _, tt := range tests {
+			target := base + tt.target
+			w := serve(sl, "GET", "http://example.com"+target, nil)
+			if w.Code != tt.status {
+				t.Errorf("%s: status %d, expected %d", target, w.Code, tt.status)
+				continue
+			}
+			if tt.status == http.StatusOK && w.Body.String() != tt.body {
+				t.Errorf("%s: body %q, expected %q", target, w.Body.String(), tt.body)
+			}
+		}
+	}
+}
+
+func TestHTTPSymlinkModes(t *testing.T) {
+	tests := []struct {
+		mode    string
+		inside  int
+		outside int
+	}{
+		{symlinksFollow, http.StatusOK, http.StatusOK},
+		{symlinksWithinRoot, http.StatusOK, http.StatusNotFound},
+		{symlinksDeny, http.StatusNotFound, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		sl := newTestSitelist(t, map[string]string{
+			"example.com/config.toml":       "[general]\nfancyFolder = \"/f/\"\nsymlinks = \"" + tt.mode + "\"\n",
+			"example.com/common/index.html": "hello",
+			"example.com/fancy/f/file.txt":  "file",
+		})
+		outside := outsideFile(t, "outside")
+		symlink(t, sl, "index.html", "example.com/common/inside.html")
+		symlink(t, sl, outside, "example.com/common/outside.html")
+		symlink(t, sl, "file.txt", "example.com/fancy/f/inside.txt")
+		symlink(t, sl, outside, "example.com/fancy/f/outside.txt")
+		if err := sl.load(); err != nil {
+			t.Fatal(err)
+		}
+
+		for target, status := range map[string]int{
+			"/inside.html":   tt.inside,
+			"/outside.html":  tt.outside,
+			"/f/inside.txt":  tt.inside,
+			"/f/outside.txt": tt.outside,
+			"/index.html":    http.StatusOK,
+			"/f/file.txt":    http.StatusOK,
+		} {
+			if w := serve(sl, "GET", "http://example.com"+target, nil); w.Code != status {
+				t.Errorf("%s with symlinks = %q: status %d, expected %d", target, tt.mode, w.Code, status)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// securityPresets are sets of headers that can be enabled for a site with
+// securityPreset in the headers section of the site configuration.
+var securityPresets = map[string]map[string]string{
+	"strict": {
+		"Strict-Transport-Security":  "max-age=63072000; includeSubDomains",
+		"X-Content-Type-Options":     "nosniff",
+		"X-Frame-Options":            "DENY",
+		"Referrer-Policy":            "strict-origin-when-cross-origin",
+		"Content-Security-Policy":    "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'",
+		"Permissions-Policy":         "camera=(), microphone=(), geolocation=()",
+		"Cross-Origin-Opener-Policy": "same-origin",
+	},
+}
+
+// matchPath matches a URL path against a pattern from the site configuration.
+// A pattern ending in a slash matches everything below it, while other
+// patterns are matched as per path.Match. Patterns without a slash are matched
+// against the last element of the path only.
+func matchPath(pattern, p string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(p, pattern)
+	}
+	if !strings.Contains(pattern, "/") {
+		p = path.Base(p)
+	}
+	matched, _ := path.Match(pattern, p)
+	return matched
+}
+
+// validatePattern checks that a pattern from the site configuration can be
+// used with matchPath.
+func validatePattern(pattern string) error {
+	if strings.Contains(pattern, "/") && !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("pattern %q must start with /", pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// validate checks the headers section of a site configuration.
+func (c *SiteConfigHeaders) validate() error {
+	if _, exists := securityPresets[c.SecurityPreset]; c.SecurityPreset != "" && !exists {
+		return fmt.Errorf("unknown security preset %q", c.SecurityPreset)
+	}
+	for _, rule := range c.Rules {
+		if rule.Path == "" {
+			continue
+		}
+		if err := validatePattern(rule.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge returns the headers section resulting from applying o on top of c. The
+// preset of o wins if set, headers set by o are added to those of c, and the
+// rules of o are applied after those of c.
+func (c *SiteConfigHeaders) merge(o *SiteConfigHeaders) *SiteConfigHeaders {
+	m := &SiteConfigHeaders{
+		SecurityPreset: c.SecurityPreset,
+		Set:            make(map[string]string, len(c.Set)+len(o.Set)),
+		Rules:          append(c.Rules[:len(c.Rules):len(c.Rules)], o.Rules...),
+	}
+	if o.SecurityPreset != "" {
+		m.SecurityPreset = o.SecurityPreset
+	}
+	for k, v := range c.Set {
+		m.Set[http.CanonicalHeaderKey(k)] = v
+	}
+	for k, v := range o.Set {
+		m.Set[http.CanonicalHeaderKey(k)] = v
+	}
+	return m
+}
+
+// evaluate computes the additional headers for a resource served at sitepath
+// with the extension ext. The security preset is applied first, then the
+// headers for all resources, and finally the matching rules in order. A header
+// set to the empty string is removed again. A nil http.Header is returned if
+// there are no additional headers.
+func (c *SiteConfigHeaders) evaluate(sitepath, ext string) http.Header {
+	h := make(http.Header)
+	apply := func(set map[string]string) {
+		for k, v := range set {
+			k = http.CanonicalHeaderKey(k)
+			if v == "" {
+				delete(h, k)
+				continue
+			}
+			h[k] = []string{v}
+		}
+	}
+
+	apply(securityPresets[c.SecurityPreset])
+	apply(c.Set)
+
+	for _, rule := range c.Rules {
+		if rule.Path != "" && !matchPath(rule.Path, sitepath) {
+			continue
+		}
+		if len(rule.Extensions) > 0 {
+			var found bool
+			for _, e := range rule.Extensions {
+				if e == ext {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		apply(rule.Set)
+	}
+
+	if len(h) == 0 {
+		return nil
+	}
+	return h
+}
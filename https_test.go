@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHTTPRedirectToHTTPS(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[general]
+defaultFile = "index.html"
+fancyFolder = "/f/"
+redirectToHTTPS = true
+httpsPort = 8443
+`,
+		"example.com/common/index.html":                       "hello",
+		"example.com/common/.well-known/acme-challenge/token": "challenge",
+	})
+
+	tests := []struct {
+		method   string
+		target   string
+		status   int
+		location string
+	}{
+		{"GET", "http://example.com/a?b=c", http.StatusMovedPermanently, "https://example.com:8443/a?b=c"},
+		{"HEAD", "http://example.com/", http.StatusMovedPermanently, "https://example.com:8443/"},
+		{"POST", "http://example.com/", http.StatusPermanentRedirect, "https://example.com:8443/"},
+		{"GET", "http://example.com/.well-known/acme-challenge/token", http.StatusOK, ""},
+		{"GET", "https://example.com/", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		w := serve(sl, tt.method, tt.target, nil)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s: status %d with Location %q, expected %d with %q", tt.method, tt.target, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
+
+func TestHTTPStrictTransportSecurity(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		hsts   string
+	}{
+		{"max-age", "[general]\ndefaultFile = \"index.html\"\nfancyFolder = \"/f/\"\nhstsMaxAge = 600\n", "max-age=600"},
+		{"max-age with redirect", "[general]\ndefaultFile = \"index.html\"\nfancyFolder = \"/f/\"\nhstsMaxAge = 600\nredirectToHTTPS = true\n", "max-age=600"},
+		{"preset", "[headers]\nsecurityPreset = \"strict\"\n", "max-age=63072000; includeSubDomains"},
+		{"explicit", "[general]\ndefaultFile = \"index.html\"\nfancyFolder = \"/f/\"\nhstsMaxAge = 600\n[headers.set]\n\"Strict-Transport-Security\" = \"max-age=1\"\n", "max-age=1"},
+		{"unset", "", ""},
+	}
+
+	for _, tt := range tests {
+		sl := newTestSitelist(t, map[string]string{
+			"example.com/config.toml":       tt.config,
+			"example.com/common/index.html": "hello",
+			"example.com/fancy/f/file.txt":  "file",
+		})
+
+		for _, target := range []string{"/", "/f/file.txt"} {
+			// Only responses over TLS carry the header.
+			if v := serve(sl, "GET", "https://example.com"+target, nil).Header().Get("Strict-Transport-Security"); v != tt.hsts {
+				t.Errorf("%s: HTTPS %s: Strict-Transport-Security %q, expected %q", tt.name, target, v, tt.hsts)
+			}
+			if v := serve(sl, "GET", "http://example.com"+target, nil).Header().Get("Strict-Transport-Security"); v != "" {
+				t.Errorf("%s: HTTP %s: Strict-Transport-Security %q", tt.name, target, v)
+			}
+		}
+	}
+}
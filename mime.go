@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// sniffLen is the amount of bytes considered when sniffing content types, as
+// per http.DetectContentType.
+const sniffLen = 512
+
+// mimeTypes is the built-in table of content types by extension. It takes
+// precedence over the mime package, whose results depend on the mime.types
+// files of the host. Charsets are added separately, as per the site
+// configuration.
+var mimeTypes = map[string]string{
+	// Text and data
+	".html":    "text/html",
+	".htm":     "text/html",
+	".xhtml":   "application/xhtml+xml",
+	".css":     "text/css",
+	".js":      "text/javascript",
+	".mjs":     "text/javascript",
+	".cjs":     "text/javascript",
+	".txt":     "text/plain",
+	".md":      "text/markdown",
+	".csv":     "text/csv",
+	".tsv":     "text/tab-separated-values",
+	".ics":     "text/calendar",
+	".vcf":     "text/vcard",
+	".vtt":     "text/vtt",
+	".xml":     "text/xml",
+	".asc":     "text/plain",
+	".json":    "application/json",
+	".jsonld":  "application/ld+json",
+	".map":     "application/json",
+	".geojson": "application/geo+json",
+	".yaml":    "application/yaml",
+	".yml":     "application/yaml",
+	".toml":    "application/toml",
+	".rss":     "application/rss+xml",
+	".atom":    "application/atom+xml",
+
+	// Web applications
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+
+	// Images
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".svg":  "image/svg+xml",
+	".ico":  "image/vnd.microsoft.icon",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".jxl":  "image/jxl",
+
+	// Fonts
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".eot":   "application/vnd.ms-fontobject",
+
+	// Audio and video
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+	".mkv":  "video/x-matroska",
+
+	// Documents and archives
+	".pdf":  "application/pdf",
+	".epub": "application/epub+zip",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".tgz":  "application/gzip",
+	".bz2":  "application/x-bzip2",
+	".xz":   "application/x-xz",
+	".zst":  "application/zstd",
+	".tar":  "application/x-tar",
+	".7z":   "application/x-7z-compressed",
+	".iso":  "application/x-iso9660-image",
+	".deb":  "application/vnd.debian.binary-package",
+	".rpm":  "application/x-rpm",
+	".apk":  "application/vnd.android.package-archive",
+	".sig":  "application/pgp-signature",
+}
+
+// contentType returns the content type for a file with the extension ext.
+// The overrides of the site are consulted first, then the built-in table. The
+// mime types of the host are deliberately not used, so that a site is served
+// the same everywhere. Files without an extension are taken as plain text, and
+// files with an unknown extension as binary. Text types get the default
+// charset of the site, unless they already specify one.
+func contentType(ext string, config *SiteConfig) string {
+	ext = strings.ToLower(ext)
+
+	t, exists := config.MIME[ext]
+	if !exists {
+		t, exists = mimeTypes[ext]
+	}
+	if !exists {
+		if ext == "" {
+			t = "text/plain"
+		} else {
+			t = "application/octet-stream"
+		}
+	}
+
+	return addCharset(t, config.General.Charset)
+}
+
+// addCharset adds charset to t if it is a text type without a charset.
+func addCharset(t, charset string) string {
+	if charset != "" && strings.HasPrefix(t, "text/") && !strings.Contains(t, "charset=") {
+		t += "; charset=" + charset
+	}
+	return t
+}
+
+// sniffContentType detects the content type of a file from b, which holds up
+// to the first sniffLen bytes of it. On top of what http.DetectContentType
+// knows, JSON and SVG are recognized, as both are common without an
+// extension, and would otherwise be taken as plain text or XML.
+func sniffContentType(b []byte) string {
+	text := bytes.TrimLeft(b, "\ufeff \t\r\n")
+	if len(text) > 0 && (text[0] == '{' || text[0] == '[') && looksLikeJSON(text, len(b) == sniffLen) {
+		return "application/json"
+	}
+	if len(text) > 0 && text[0] == '<' && bytes.Contains(bytes.ToLower(text), []byte("<svg")) {
+		return "image/svg+xml"
+	}
+	return http.DetectContentType(b)
+}
+
+// sniffFile returns up to the first sniffLen bytes of the file at p, or nil if
+// it cannot be read.
+func sniffFile(p string) []byte {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	b := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, b)
+	return b[:n]
+}
+
+// looksLikeJSON reports whether b is JSON. If truncated is set, b may end in
+// the middle of a value.
+func looksLikeJSON(b []byte, truncated bool) bool {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		_, err := dec.Token()
+		switch {
+		case err == io.EOF:
+			return true
+		case err == io.ErrUnexpectedEOF:
+			return truncated
+		case err != nil:
+			// A value cut off in the middle is reported as a syntax error
+			// at the end of the input.
+			if serr, ok := err.(*json.SyntaxError); ok && truncated && serr.Offset >= int64(len(b)) {
+				return true
+			}
+			return false
+		}
+	}
+}
+
+// normalizeMIME validates the MIME overrides of a site configuration, and
+// returns them keyed by lower case extension with a leading dot.
+func normalizeMIME(m map[string]string) (map[string]string, error) {
+	n := make(map[string]string, len(m))
+	for ext, t := range m {
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			return nil, fmt.Errorf("content type %q for %s: %v", t, ext, err)
+		}
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		n[ext] = t
+	}
+	return n, nil
+}
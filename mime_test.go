@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestContentType(t *testing.T) {
+	overrides, err := normalizeMIME(map[string]string{
+		"GMI": "text/gemini",
+		".md": "text/markdown; charset=iso-8859-1",
+		".js": "application/javascript",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &SiteConfig{
+		General: &SiteConfigGeneral{Charset: "utf-8"},
+		MIME:    overrides,
+	}
+
+	tests := []struct {
+		ext     string
+		cnttype string
+	}{
+		{".html", "text/html; charset=utf-8"},
+		{".HTML", "text/html; charset=utf-8"},
+		{".css", "text/css; charset=utf-8"},
+		{".png", "image/png"},
+		{".svg", "image/svg+xml"},
+		{".json", "application/json"},
+		{".wasm", "application/wasm"},
+		{"", "text/plain; charset=utf-8"},
+		{".unknown", "application/octet-stream"},
+
+		// Overrides win over the table, and keep their own charset.
+		{".gmi", "text/gemini; charset=utf-8"},
+		{".md", "text/markdown; charset=iso-8859-1"},
+		{".js", "application/javascript"},
+	}
+
+	for _, tt := range tests {
+		if cnttype := contentType(tt.ext, config); cnttype != tt.cnttype {
+			t.Errorf("contentType(%q) = %q, expected %q", tt.ext, cnttype, tt.cnttype)
+		}
+	}
+
+	// Without a charset, text types are left alone.
+	config.General.Charset = ""
+	if cnttype := contentType(".html", config); cnttype != "text/html" {
+		t.Errorf("contentType(.html) without charset = %q, expected %q", cnttype, "text/html")
+	}
+}
+
+func TestNormalizeMIME(t *testing.T) {
+	if _, err := normalizeMIME(map[string]string{".x": "not a type/"}); err == nil {
+		t.Errorf("invalid content type accepted")
+	}
+}
+
+func TestHTTPMIMEOverrides(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[mime]
+"gmi" = "text/gemini"
+`,
+		"example.com/common/index.gmi": "# hello",
+		"example.com/fancy/f/page.gmi": "# hello",
+	})
+
+	for _, target := range []string{"/index.gmi", "/f/page.gmi"} {
+		w := serve(sl, "GET", "http://example.com"+target, nil)
+		if v := w.Header().Get("Content-Type"); w.Code != http.StatusOK || v != "text/gemini; charset=utf-8" {
+			t.Errorf("%s: status %d with Content-Type %q", target, w.Code, v)
+		}
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		content string
+		cnttype string
+	}{
+		{"<!DOCTYPE html><p>hello", "text/html; charset=utf-8"},
+		{"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{`{"a": [1, 2]}`, "application/json"},
+		{" [1, 2, 3]", "application/json"},
+		{"[not json", "text/plain; charset=utf-8"},
+		{`<svg xmlns="http://www.w3.org/2000/svg"></svg>`, "image/svg+xml"},
+		{"just some text", "text/plain; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		if cnttype := sniffContentType([]byte(tt.content)); cnttype != tt.cnttype {
+			t.Errorf("sniffContentType(%q) = %q, expected %q", tt.content, cnttype, tt.cnttype)
+		}
+	}
+
+	// JSON cut off at the sniffing length is still recognized.
+	long := `{"a": "` + strings.Repeat("x", sniffLen) + `"}`
+	if cnttype := sniffContentType([]byte(long[:sniffLen])); cnttype != "application/json" {
+		t.Errorf("truncated JSON sniffed as %q", cnttype)
+	}
+}
+
+func TestHTTPSniffContentType(t *testing.T) {
+	files := map[string]string{
+		"example.com/common/index.html":            "hello",
+		"example.com/common/apple-app-association": `{"applinks": {}}`,
+		"example.com/common/LICENSE":               "Permission is hereby granted",
+		"example.com/fancy/f/manifest":             `{"name": "x"}`,
+	}
+
+	for _, sniff := range []bool{false, true} {
+		if sniff {
+			files["example.com/config.toml"] = "[general]\nsniffContentType = true\nfancyFolder = \"/f/\"\n"
+		}
+		sl := newTestSitelist(t, files)
+
+		json := "text/plain; charset=utf-8"
+		if sniff {
+			json = "application/json"
+		}
+		for target, cnttype := range map[string]string{
+			"/apple-app-association": json,
+			"/LICENSE":               "text/plain; charset=utf-8",
+			"/f/manifest":            json,
+		} {
+			w := serve(sl, "GET", "http://example.com"+target, nil)
+			if v := w.Header().Get("Content-Type"); w.Code != http.StatusOK || v != cnttype {
+				t.Errorf("%s with sniffing %v: status %d with Content-Type %q, expected %q", target, sniff, w.Code, v, cnttype)
+			}
+		}
+	}
+}
@@ -99,12 +99,34 @@ func main() {
 	}
 
 	// Load sitelist
+	rl := conf.RateLimit
 	sl := &sitelist{
 		root:        conf.Root,
 		defaulthost: conf.DefaultHost,
+		limits:      newRateLimits(rl.Rate.PerSecond, rl.Burst, rl.DiskRate.PerSecond, rl.DiskBurst, rl.MaxClients),
 		logger:      logger,
 	}
 
+	// Files larger than the maximum file size are always served from disk,
+	// so that a single large file cannot exhaust memory.
+	mem := conf.Memory
+	if mem.MaxFileSize.Bytes == 0 {
+		mem.MaxFileSize = DefaultMemoryMaxFileSize
+	}
+	sl.memory = budget{limit: mem.Budget.Bytes, maxFileSize: mem.MaxFileSize.Bytes}
+
+	// The compression cache is enabled unless disabled explicitly, as it only
+	// uses memory for files that are actually requested.
+	if cc := conf.CompressionCache; !cc.Disabled {
+		if cc.Size.Bytes == 0 {
+			cc.Size = DefaultCompressionCacheSize
+		}
+		if cc.MaxFileSize.Bytes == 0 {
+			cc.MaxFileSize = DefaultCompressionCacheMaxFileSize
+		}
+		sl.compressed = newCompressionCache(cc.Size.Bytes, cc.MaxFileSize.Bytes)
+	}
+
 	if err = sl.load(); err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to walk files: %v\n", err)
 		return
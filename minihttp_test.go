@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testModTime is the modification time given to all files in the test root.
+var testModTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// etagRegexp matches a well-formed entity-tag, as per RFC 9110, section 8.8.3.
+var etagRegexp = regexp.MustCompile(`^(W/)?"[^"]*"$`)
+
+// newTestSitelist writes files to a temporary root and loads a sitelist from
+// it. The keys of files are slash-separated paths relative to the root.
+func newTestSitelist(t *testing.T, files map[string]string) *sitelist {
+	root := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, testModTime, testModTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sl := &sitelist{
+		root:   root,
+		memory: budget{maxFileSize: DefaultMemoryMaxFileSize.Bytes},
+		logger: func(string, ...interface{}) {},
+	}
+	if err := sl.load(); err != nil {
+		t.Fatal(err)
+	}
+	return sl
+}
+
+// serve performs a request against the sitelist.
+func serve(sl *sitelist, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	sl.http(w, req)
+	return w
+}
+
+// checkValidators checks that the response carries a quoted entity-tag, and
+// dates in the format required by RFC 9110, section 5.6.7.
+func checkValidators(t *testing.T, target string, w *httptest.ResponseRecorder, modified time.Time) {
+	t.Helper()
+	h := w.Header()
+
+	if etag := h.Get("ETag"); !etagRegexp.MatchString(etag) {
+		t.Errorf("%s: malformed ETag %q", target, etag)
+	}
+
+	for _, k := range []string{"Date", "Last-Modified"} {
+		v := h.Get(k)
+		if !strings.HasSuffix(v, " GMT") {
+			t.Errorf("%s: %s %q is not in GMT", target, k, v)
+		}
+		if _, err := time.Parse(http.TimeFormat, v); err != nil {
+			t.Errorf("%s: %s %q: %v", target, k, v, err)
+		}
+	}
+
+	if !modified.IsZero() {
+		if v, expected := h.Get("Last-Modified"), modified.Format(http.TimeFormat); v != expected {
+			t.Errorf("%s: Last-Modified %q, expected %q", target, v, expected)
+		}
+	}
+}
+
+func TestHTTPResources(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/common/index.html": "<p>hello</p>",
+		"example.com/common/style.css":  "p { color: red; }",
+		"example.com/fancy/f/large.txt": strings.Repeat("large ", 1024),
+	})
+
+	tests := []struct {
+		target  string
+		body    string
+		cnttype string
+	}{
+		{"http://example.com/", "<p>hello</p>", "text/html; charset=utf-8"},
+		{"http://example.com/style.css", "p { color: red; }", "text/css; charset=utf-8"},
+		{"http://example.com/f/large.txt", strings.Repeat("large ", 1024), "text/plain; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		w := serve(sl, "GET", tt.target, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d, expected %d", tt.target, w.Code, http.StatusOK)
+			continue
+		}
+		if body := w.Body.String(); body != tt.body {
+			t.Errorf("%s: body %q, expected %q", tt.target, body, tt.body)
+		}
+		if cnttype := w.Header().Get("Content-Type"); cnttype != tt.cnttype {
+			t.Errorf("%s: Content-Type %q, expected %q", tt.target, cnttype, tt.cnttype)
+		}
+		checkValidators(t, tt.target, w, testModTime)
+
+		// The validators we sent must be accepted back.
+		h := w.Header()
+		for k, v := range map[string]string{
+			"If-None-Match":     h.Get("ETag"),
+			"If-Modified-Since": h.Get("Last-Modified"),
+		} {
+			if w := serve(sl, "GET", tt.target, http.Header{k: {v}}); w.Code != http.StatusNotModified {
+				t.Errorf("%s: %s: %s: status %d, expected %d", tt.target, k, v, w.Code, http.StatusNotModified)
+			}
+		}
+	}
+}
+
+func TestHTTPDefaultErrors(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/common/index.html": "<p>hello</p>",
+	})
+
+	tests := []struct {
+		target string
+		status int
+		res    *resource
+	}{
+		{"http://example.com/missing", http.StatusNotFound, defaultNoSuchFile},
+		{"http://example.org/", http.StatusForbidden, defaultNoSuchHost},
+	}
+
+	for _, tt := range tests {
+		w := serve(sl, "GET", tt.target, nil)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.target, w.Code, tt.status)
+		}
+		if body := w.Body.String(); body != string(tt.res.body) {
+			t.Errorf("%s: body %q, expected %q", tt.target, body, tt.res.body)
+		}
+		if etag := w.Header().Get("ETag"); etag != tt.res.hash {
+			t.Errorf("%s: ETag %q, expected %q", tt.target, etag, tt.res.hash)
+		}
+		checkValidators(t, tt.target, w, time.Time{})
+	}
+}
+
+func TestHTTPRootErrors(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"404.html":                      "root not found",
+		"403.html":                      "root no such host",
+		"example.com/common/index.html": "<p>hello</p>",
+	})
+
+	tests := []struct {
+		target string
+		status int
+		body   string
+	}{
+		{"http://example.com/missing", http.StatusNotFound, "root not found"},
+		{"http://example.org/", http.StatusForbidden, "root no such host"},
+	}
+
+	for _, tt := range tests {
+		w := serve(sl, "GET", tt.target, nil)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.target, w.Code, tt.status)
+		}
+		if body := w.Body.String(); body != tt.body {
+			t.Errorf("%s: body %q, expected %q", tt.target, body, tt.body)
+		}
+		checkValidators(t, tt.target, w, testModTime)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mount serves the files of a directory below a URL prefix, streaming them
+// from disk on request.
+type mount struct {
+	prefix string
+	dir    string
+	config *SiteConfig
+}
+
+// newMount creates a mount from a mount block of the site configuration. The
+// general section of the mount configuration carries its listing settings,
+// and its prefix as the from-disk folder, so that listings know where the
+// mount starts.
+func newMount(conf SiteConfigMount, site *SiteConfig, dir string) *mount {
+	general := *site.General
+	general.FancyFolder = conf.Prefix
+	general.AutoIndex = conf.AutoIndex
+	general.AutoIndexSort = conf.AutoIndexSort
+	general.AutoIndexHidden = conf.AutoIndexHidden
+
+	c := *site
+	c.General = &general
+	c.Cache = conf.Cache
+	c.Compression = conf.Compression
+
+	if !filepath.IsAbs(conf.Dir) {
+		conf.Dir = path.Join(dir, conf.Dir)
+	}
+
+	return &mount{
+		prefix: conf.Prefix,
+		dir:    path.Clean(conf.Dir),
+		config: &c,
+	}
+}
+
+// matches reports whether the cleaned path p is served by the mount. This
+// includes the prefix without its trailing slash, which is redirected.
+func (m *mount) matches(p string) bool {
+	return strings.HasPrefix(p, m.prefix) || p+"/" == m.prefix
+}
+
+// resolve maps the cleaned path p to a path within the directory of the
+// mount. If the result would be outside of the directory, false is returned.
+func (m *mount) resolve(p string) (string, bool) {
+	rel := "/"
+	if strings.HasPrefix(p, m.prefix) {
+		rel = p[len(m.prefix):]
+	}
+
+	diskpath := path.Join(m.dir, rel)
+	if r, err := filepath.Rel(m.dir, diskpath); err != nil || r == ".." || strings.HasPrefix(r, "../") {
+		return "", false
+	}
+	return diskpath, true
+}
+
+// mountFor returns the mount with the longest prefix matching the cleaned
+// path p, if any.
+func (s *site) mountFor(p string) *mount {
+	for _, m := range s.mounts {
+		if m.matches(p) {
+			return m
+		}
+	}
+	return nil
+}
+
+// loadMounts sets up the mounts of the site. The from-disk folder is a mount
+// of the fancy directory of the site, with the prefix kept in the path. The
+// mounts are ordered by descending prefix length, so that the first match is
+// the longest. Mounts of directories that do not exist are kept, but reported
+// as errors.
+func (s *site) loadMounts() []error {
+	var errs []error
+
+	s.mounts = nil
+	for _, conf := range s.config.Mount {
+		m := newMount(conf, s.config, s.dir)
+		if fi, err := os.Stat(m.dir); err != nil {
+			errs = append(errs, err)
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("%s is not a directory", m.dir))
+		}
+		s.mounts = append(s.mounts, m)
+	}
+
+	// The from-disk folder goes last, so that mounts win ties.
+	fancy := s.config.General.FancyFolder
+	s.mounts = append(s.mounts, &mount{
+		prefix: fancy,
+		dir:    path.Join(s.dir, "fancy", fancy),
+		config: s.config,
+	})
+
+	sort.SliceStable(s.mounts, func(i, j int) bool {
+		return len(s.mounts[i].prefix) > len(s.mounts[j].prefix)
+	})
+
+	return errs
+}
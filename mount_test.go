@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMountFor(t *testing.T) {
+	conf := DefaultSiteConfig
+	conf.Mount = []SiteConfigMount{
+		{Prefix: "/dl/", Dir: "releases"},
+		{Prefix: "/dl/nightly/", Dir: "/data/nightly"},
+		{Prefix: "/f/sub/", Dir: "sub"},
+	}
+	s := newSite("/srv/example.com", &conf)
+	s.loadMounts()
+
+	tests := []struct {
+		path string
+		dir  string
+	}{
+		{"/dl/a.txt", "/srv/example.com/releases"},
+		{"/dl/", "/srv/example.com/releases"},
+		{"/dl", "/srv/example.com/releases"},
+		{"/dl/nightly/b.txt", "/data/nightly"},
+		{"/dl/nightly", "/data/nightly"},
+		{"/dl/nightlyx", "/srv/example.com/releases"},
+		{"/f/x.txt", "/srv/example.com/fancy/f"},
+		{"/f/sub/y.txt", "/srv/example.com/sub"},
+		{"/", ""},
+		{"/dlx", ""},
+	}
+
+	for _, tt := range tests {
+		var dir string
+		if m := s.mountFor(tt.path); m != nil {
+			dir = m.dir
+		}
+		if dir != tt.dir {
+			t.Errorf("mountFor(%q) = %q, expected %q", tt.path, dir, tt.dir)
+		}
+	}
+}
+
+func TestHTTPMounts(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[[mount]]
+prefix = "/dl/"
+dir = "releases"
+
+[[mount]]
+prefix = "/dl/nightly"
+dir = "nightly"
+
+[[mount]]
+prefix = "/f/sub/"
+dir = "sub"
+
+[[mount]]
+prefix = "/missing/"
+dir = "missing"
+`,
+		"example.com/common/index.html":      "hello",
+		"example.com/common/dl/memory.txt":   "from memory",
+		"example.com/releases/a.txt":         "release",
+		"example.com/releases/memory.txt":    "from releases",
+		"example.com/releases/nightly/b.txt": "shadowed",
+		"example.com/nightly/b.txt":          "nightly",
+		"example.com/fancy/f/x.txt":          "fancy",
+		"example.com/fancy/f/sub/y.txt":      "shadowed",
+		"example.com/sub/y.txt":              "sub",
+	})
+
+	tests := []struct {
+		target string
+		status int
+		body   string
+	}{
+		{"/dl/a.txt", http.StatusOK, "release"},
+		{"/dl/nightly/b.txt", http.StatusOK, "nightly"},
+		{"/f/x.txt", http.StatusOK, "fancy"},
+		{"/f/sub/y.txt", http.StatusOK, "sub"},
+
+		// Files in memory take precedence over mounts.
+		{"/dl/memory.txt", http.StatusOK, "from memory"},
+
+		// Paths cannot escape the directory of their mount.
+		{"/dl/../config.toml", http.StatusNotFound, ""},
+		{"/dl/%2e%2e/config.toml", http.StatusNotFound, ""},
+		{"/dl/nightly/../../config.toml", http.StatusNotFound, ""},
+
+		// The prefix without its trailing slash is redirected.
+		{"/dl", http.StatusMovedPermanently, ""},
+		{"/missing/x", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		w := serve(sl, "GET", "http://example.com"+tt.target, nil)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.target, w.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK && w.Body.String() != tt.body {
+			t.Errorf("%s: body %q, expected %q", tt.target, w.Body.String(), tt.body)
+		}
+	}
+
+	if w := serve(sl, "GET", "http://example.com/dl", nil); w.Header().Get("Location") != "/dl/" {
+		t.Errorf("/dl: Location %q, expected %q", w.Header().Get("Location"), "/dl/")
+	}
+
+	var reported bool
+	for _, d := range sl.diagnostics {
+		reported = reported || strings.Contains(d, "mount") && strings.Contains(d, "missing")
+	}
+	if !reported {
+		t.Errorf("missing mount directory not reported in %q", sl.diagnostics)
+	}
+}
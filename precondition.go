@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parseHTTPDate parses an HTTP-date in any of the formats RFC 9110 requires us
+// to accept. It also accepts time.RFC1123 with a zone other than GMT, as older
+// versions of this server sent Last-Modified in that format.
+func parseHTTPDate(s string) (time.Time, bool) {
+	t, err := http.ParseTime(s)
+	if err != nil {
+		if t, err = time.Parse(time.RFC1123, s); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return t, true
+}
+
+// parseETags splits a list of entity-tags, as found in If-Match and
+// If-None-Match. Entity-tags are returned with their weakness indicator and
+// quotes intact, so they can be compared directly to the tags we send.
+// Unquoted tags are accepted for leniency.
+func parseETags(s string) []string {
+	var tags []string
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return tags
+		}
+
+		var prefix string
+		if strings.HasPrefix(s, "W/") {
+			prefix, s = "W/", s[2:]
+		}
+
+		var end int
+		if strings.HasPrefix(s, `"`) {
+			// The opaque tag may contain commas, so we look for the closing
+			// quote rather than the next comma.
+			if end = strings.IndexByte(s[1:], '"'); end < 0 {
+				return tags
+			}
+			end += 2
+		} else if end = strings.IndexByte(s, ','); end < 0 {
+			end = len(s)
+		}
+
+		tags = append(tags, prefix+strings.TrimRight(s[:end], " \t"))
+		s = s[end:]
+	}
+}
+
+// etagStrongMatch performs the strong comparison from RFC 9110, section 8.8.3.2.
+func etagStrongMatch(a, b string) bool {
+	return a == b && !strings.HasPrefix(a, "W/")
+}
+
+// etagWeakMatch performs the weak comparison from RFC 9110, section 8.8.3.2.
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// etagListMatch reports whether any entity-tag in the header value matches
+// etag, using the provided comparison function.
+func etagListMatch(header, etag string, match func(a, b string) bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, t := range parseETags(header) {
+		if match(t, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates the conditional headers of a request for an
+// existing resource, in the order given by RFC 9110, section 13.2.2. The etag
+// must be the entity-tag of the selected representation. It returns 0 if the
+// request should proceed normally, or http.StatusNotModified or
+// http.StatusPreconditionFailed if it should be answered with that status.
+func checkPreconditions(h http.Header, method, etag string, modified time.Time) int {
+	var (
+		v      string
+		exists bool
+	)
+
+	// HTTP dates have a resolution of a second.
+	modified = modified.Truncate(time.Second)
+
+	if v, exists = quickHeaderGet("If-Match", h); exists {
+		if !etagListMatch(v, etag, etagStrongMatch) {
+			return http.StatusPreconditionFailed
+		}
+	} else if v, exists = quickHeaderGet("If-Unmodified-Since", h); exists {
+		if t, ok := parseHTTPDate(v); ok && modified.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	getOrHead := method == "GET" || method == "HEAD"
+
+	if v, exists = quickHeaderGet("If-None-Match", h); exists {
+		if etagListMatch(v, etag, etagWeakMatch) {
+			if getOrHead {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if v, exists = quickHeaderGet("If-Modified-Since", h); exists && getOrHead {
+		if t, ok := parseHTTPDate(v); ok && !modified.After(t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// ifRange reports whether a Range header should be honoured, as per the
+// If-Range precondition in RFC 9110, section 13.1.5. Entity-tags must match
+// strongly, so weak entity-tags never satisfy If-Range. Dates must match the
+// modification time exactly.
+func (r *resource) ifRange(h http.Header) bool {
+	v, exists := quickHeaderGet("If-Range", h)
+	if !exists {
+		return true
+	}
+
+	if strings.HasPrefix(v, "W/") || strings.HasPrefix(v, `"`) || v == r.hash {
+		return etagStrongMatch(v, r.hash)
+	}
+
+	t, ok := parseHTTPDate(v)
+	return ok && t.Unix() == r.loaded.Unix()
+}
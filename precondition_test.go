@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseETags(t *testing.T) {
+	tests := []struct {
+		header string
+		tags   []string
+	}{
+		{"", nil},
+		{`"abc"`, []string{`"abc"`}},
+		{`W/"abc"`, []string{`W/"abc"`}},
+		{`"a", W/"b" ,"c"`, []string{`"a"`, `W/"b"`, `"c"`}},
+		{`"a,b", W/"c,d"`, []string{`"a,b"`, `W/"c,d"`}},
+		{`,, "a" ,`, []string{`"a"`}},
+		{`abc, def`, []string{`abc`, `def`}},
+		{`"a", "unterminated`, []string{`"a"`}},
+	}
+
+	for _, tt := range tests {
+		if tags := parseETags(tt.header); !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("parseETags(%q) = %q, expected %q", tt.header, tags, tt.tags)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	var (
+		modified = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		before   = modified.Add(-time.Hour).Format(http.TimeFormat)
+		at       = modified.Format(http.TimeFormat)
+	)
+
+	tests := []struct {
+		method  string
+		etag    string
+		headers map[string]string
+		status  int
+	}{
+		{"GET", `"a"`, nil, 0},
+
+		// If-Match uses strong comparison.
+		{"GET", `"a"`, map[string]string{"If-Match": `"a"`}, 0},
+		{"GET", `"a"`, map[string]string{"If-Match": `"b", "a"`}, 0},
+		{"GET", `"a"`, map[string]string{"If-Match": `"b"`}, http.StatusPreconditionFailed},
+		{"GET", `"a"`, map[string]string{"If-Match": `W/"a"`}, http.StatusPreconditionFailed},
+		{"GET", `W/"a"`, map[string]string{"If-Match": `W/"a"`}, http.StatusPreconditionFailed},
+		{"GET", `"a,b"`, map[string]string{"If-Match": `"x", "a,b"`}, 0},
+		{"GET", `"a"`, map[string]string{"If-Match": `*`}, 0},
+
+		// If-None-Match uses weak comparison.
+		{"GET", `"a"`, map[string]string{"If-None-Match": `"a"`}, http.StatusNotModified},
+		{"GET", `"a"`, map[string]string{"If-None-Match": `W/"a"`}, http.StatusNotModified},
+		{"HEAD", `W/"a"`, map[string]string{"If-None-Match": `"b", W/"a"`}, http.StatusNotModified},
+		{"GET", `"a,b"`, map[string]string{"If-None-Match": `"a", "b"`}, 0},
+		{"GET", `"a,b"`, map[string]string{"If-None-Match": `"x", W/"a,b"`}, http.StatusNotModified},
+		{"GET", `"a"`, map[string]string{"If-None-Match": `*`}, http.StatusNotModified},
+		{"POST", `"a"`, map[string]string{"If-None-Match": `"a"`}, http.StatusPreconditionFailed},
+
+		// Dates are only consulted in the absence of entity-tags.
+		{"GET", `"a"`, map[string]string{"If-Unmodified-Since": before}, http.StatusPreconditionFailed},
+		{"GET", `"a"`, map[string]string{"If-Unmodified-Since": at}, 0},
+		{"GET", `"a"`, map[string]string{"If-Match": `"a"`, "If-Unmodified-Since": before}, 0},
+		{"GET", `"a"`, map[string]string{"If-Modified-Since": at}, http.StatusNotModified},
+		{"GET", `"a"`, map[string]string{"If-Modified-Since": before}, 0},
+		{"GET", `"a"`, map[string]string{"If-None-Match": `"b"`, "If-Modified-Since": at}, 0},
+		{"POST", `"a"`, map[string]string{"If-Modified-Since": at}, 0},
+		{"GET", `"a"`, map[string]string{"If-Modified-Since": "yesterday"}, 0},
+	}
+
+	for _, tt := range tests {
+		h := make(http.Header)
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		if status := checkPreconditions(h, tt.method, tt.etag, modified); status != tt.status {
+			t.Errorf("checkPreconditions(%v, %s, %s) = %d, expected %d", tt.headers, tt.method, tt.etag, status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errUnsatisfiableRange is returned by parseRange if a Range header was well
+// formed, but none of the ranges it specified overlapped the resource.
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+// httpRange specifies a byte range within a resource body.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header as per RFC 7233, section 2.1. A header that
+// is not understood results in nil ranges and a nil error, in which case the
+// header should be ignored, and the full representation served. If none of the
+// ranges can be satisfied, errUnsatisfiableRange is returned.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, nil
+	}
+
+	var (
+		ranges        []httpRange
+		total         int64
+		unsatisfiable bool
+	)
+
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, nil
+		}
+
+		var (
+			r          httpRange
+			start, end = textproto.TrimString(ra[:i]), textproto.TrimString(ra[i+1:])
+		)
+
+		if start == "" {
+			// Suffix range, "-N", requesting the last N bytes.
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				unsatisfiable = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, nil
+			}
+			if i >= size {
+				// The range starts beyond the end of the resource, so we skip
+				// it, but it is still syntactically valid.
+				unsatisfiable = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, nil
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+
+		total += r.length
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		if unsatisfiable {
+			return nil, errUnsatisfiableRange
+		}
+		return nil, nil
+	}
+
+	// A client asking for more data than the resource holds in total is either
+	// confused or malicious. Either way, it is better served with the full
+	// representation.
+	if total > size {
+		return nil, nil
+	}
+
+	return ranges, nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// rangeResponse sets the headers for a 206 Partial Content response for the
+// given ranges of src, and returns a function that writes the matching body.
+// A single range is served as is, while multiple ranges are served as
+// multipart/byteranges.
+func rangeResponse(h http.Header, src io.ReaderAt, size int64, ranges []httpRange, cnttype string) func(io.Writer) error {
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		h["Content-Range"] = []string{ra.contentRange(size)}
+		h["Content-Length"] = []string{strconv.FormatInt(ra.length, 10)}
+		return func(w io.Writer) error {
+			// Copying from the file itself permits the use of sendfile.
+			if f, ok := src.(*os.File); ok {
+				if _, err := f.Seek(ra.start, io.SeekStart); err != nil {
+					return err
+				}
+				_, err := io.CopyN(w, f, ra.length)
+				return err
+			}
+			_, err := io.Copy(w, io.NewSectionReader(src, ra.start, ra.length))
+			return err
+		}
+	}
+
+	partHeader := func(ra httpRange) textproto.MIMEHeader {
+		return textproto.MIMEHeader{
+			"Content-Type":  {cnttype},
+			"Content-Range": {ra.contentRange(size)},
+		}
+	}
+
+	// We do a dry run of the multipart encoding to figure out the
+	// Content-Length.
+	var cw countingWriter
+	mw := multipart.NewWriter(&cw)
+	boundary := mw.Boundary()
+	for _, ra := range ranges {
+		mw.CreatePart(partHeader(ra))
+		cw += countingWriter(ra.length)
+	}
+	mw.Close()
+
+	h["Content-Type"] = []string{"multipart/byteranges; boundary=" + boundary}
+	h["Content-Length"] = []string{strconv.FormatInt(int64(cw), 10)}
+	delete(h, "Content-Encoding")
+
+	return func(w io.Writer) error {
+		mw := multipart.NewWriter(w)
+		mw.SetBoundary(boundary)
+		for _, ra := range ranges {
+			part, err := mw.CreatePart(partHeader(ra))
+			if err != nil {
+				return err
+			}
+			if _, err = io.Copy(part, io.NewSectionReader(src, ra.start, ra.length)); err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+	}
+}
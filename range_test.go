@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		ranges []httpRange
+		err    error
+	}{
+		// Not understood, served in full.
+		{"", 10, nil, nil},
+		{"items=0-1", 10, nil, nil},
+		{"bytes=1", 10, nil, nil},
+		{"bytes=5-1", 10, nil, nil},
+		{"bytes=a-b", 10, nil, nil},
+
+		{"bytes=0-4", 10, []httpRange{{0, 5}}, nil},
+		{"bytes=5-", 10, []httpRange{{5, 5}}, nil},
+		{"bytes=5-100", 10, []httpRange{{5, 5}}, nil},
+		{"bytes=0-1, 4-5", 10, []httpRange{{0, 2}, {4, 2}}, nil},
+
+		// Suffix ranges.
+		{"bytes=-3", 10, []httpRange{{7, 3}}, nil},
+		{"bytes=-100", 10, []httpRange{{0, 10}}, nil},
+		{"bytes=-0", 10, nil, errUnsatisfiableRange},
+
+		// Unsatisfiable ranges are skipped, unless nothing else is left.
+		{"bytes=10-", 10, nil, errUnsatisfiableRange},
+		{"bytes=20-30", 10, nil, errUnsatisfiableRange},
+		{"bytes=0-", 0, nil, errUnsatisfiableRange},
+		{"bytes=-1", 0, nil, errUnsatisfiableRange},
+		{"bytes=20-30, 0-0", 10, []httpRange{{0, 1}}, nil},
+
+		// Overlapping ranges asking for more than the size are served in full.
+		{"bytes=0-, 0-", 10, nil, nil},
+		{"bytes=0-5, 2-8", 10, nil, nil},
+		{"bytes=-6, 0-5", 10, nil, nil},
+		{"bytes=0-3, 2-5", 10, []httpRange{{0, 4}, {2, 4}}, nil},
+	}
+
+	for _, tt := range tests {
+		ranges, err := parseRange(tt.header, tt.size)
+		if err != tt.err {
+			t.Errorf("parseRange(%q, %d): error %v, expected %v", tt.header, tt.size, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(ranges, tt.ranges) {
+			t.Errorf("parseRange(%q, %d) = %v, expected %v", tt.header, tt.size, ranges, tt.ranges)
+		}
+	}
+}
+
+func TestHTTPIfRange(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/common/file.txt":  content,
+		"example.com/fancy/f/file.txt": content,
+	})
+
+	for _, target := range []string{"http://example.com/file.txt", "http://example.com/f/file.txt"} {
+		w := serve(sl, "GET", target, nil)
+		etag, modified := w.Header().Get("Etag"), w.Header().Get("Last-Modified")
+		if w.Code != http.StatusOK || strings.HasPrefix(etag, "W/") {
+			t.Errorf("%s: status %d with ETag %q, expected a strong entity-tag", target, w.Code, etag)
+			continue
+		}
+
+		tests := []struct {
+			ifRange string
+			status  int
+		}{
+			{etag, http.StatusPartialContent},
+			{modified, http.StatusPartialContent},
+			{"W/" + etag, http.StatusOK},
+			{`"other"`, http.StatusOK},
+			{"Mon, 02 Jan 2006 15:04:05 GMT", http.StatusOK},
+		}
+
+		for _, tt := range tests {
+			// The identity representation is served for ranges, even if the
+			// client would accept an encoded one.
+			w := serve(sl, "GET", target, http.Header{
+				"Range":           {"bytes=10-19"},
+				"If-Range":        {tt.ifRange},
+				"Accept-Encoding": {"gzip"},
+			})
+			if w.Code != tt.status {
+				t.Errorf("%s with If-Range %q: status %d, expected %d", target, tt.ifRange, w.Code, tt.status)
+				continue
+			}
+			if tt.status == http.StatusPartialContent && w.Body.String() != content[10:20] {
+				t.Errorf("%s with If-Range %q: body %q", target, tt.ifRange, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaxClients is the default amount of clients a limiter tracks.
+const defaultMaxClients = 65536
+
+// tokenBucket is the state of a single client of a limiter.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter implements per-client token buckets. The table of buckets is kept
+// in two generations. When the current generation is full, it becomes the
+// previous one, and the previous one is dropped. Clients that have not been
+// seen for a full generation thus lose their bucket, which at worst gives them
+// a full bucket again. This bounds memory without having to sweep the table.
+type limiter struct {
+	rate  float64
+	burst float64
+	max   int
+
+	lock      sync.Mutex
+	cur, prev map[string]*tokenBucket
+
+	// stats
+	allowed uint64
+	limited uint64
+}
+
+// newLimiter returns a limiter permitting rate requests per second per client,
+// with bursts of up to burst requests. It returns nil if rate is not positive.
+func newLimiter(rate float64, burst, max int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	if max <= 0 {
+		max = defaultMaxClients
+	}
+	return &limiter{
+		rate:  rate,
+		burst: float64(burst),
+		max:   max,
+		cur:   make(map[string]*tokenBucket),
+		prev:  make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of a client. If none are available, it
+// returns false and the time until one is.
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	b, exists := l.cur[key]
+	if !exists {
+		if b, exists = l.prev[key]; exists {
+			delete(l.prev, key)
+		} else {
+			b = &tokenBucket{tokens: l.burst, last: now}
+		}
+		if len(l.cur) >= l.max/2 {
+			l.prev = l.cur
+			l.cur = make(map[string]*tokenBucket)
+		}
+		l.cur[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		l.lock.Unlock()
+		atomic.AddUint64(&l.limited, 1)
+		return false, wait
+	}
+
+	b.tokens--
+	l.lock.Unlock()
+	atomic.AddUint64(&l.allowed, 1)
+	return true, 0
+}
+
+// status returns a line describing the limiter for the status report.
+func (l *limiter) status(name string) string {
+	l.lock.Lock()
+	clients := len(l.cur) + len(l.prev)
+	l.lock.Unlock()
+	return fmt.Sprintf("\t%s: %.1f/s (burst %.0f), %d allowed, %d limited, %d clients tracked\n",
+		name, l.rate, l.burst, atomic.LoadUint64(&l.allowed), atomic.LoadUint64(&l.limited), clients)
+}
+
+// rateLimits holds the limiters for memory and from-disk resources. Either
+// may be nil, in which case that kind of resource is not limited.
+type rateLimits struct {
+	mem  *limiter
+	disk *limiter
+}
+
+// newRateLimits creates the limiters for a rate limit configuration.
+func newRateLimits(rate float64, burst int, diskRate float64, diskBurst, maxClients int) *rateLimits {
+	return &rateLimits{
+		mem:  newLimiter(rate, burst, maxClients),
+		disk: newLimiter(diskRate, diskBurst, maxClients),
+	}
+}
+
+// allow applies the limiter for the kind of resource to a client.
+func (rl *rateLimits) allow(key string, fromDisk bool, now time.Time) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	l := rl.mem
+	if fromDisk {
+		l = rl.disk
+	}
+	if l == nil {
+		return true, 0
+	}
+	return l.allow(key, now)
+}
+
+// status returns the lines describing the limiters for the status report.
+func (rl *rateLimits) status(name string) string {
+	var s string
+	if rl == nil {
+		return s
+	}
+	if rl.mem != nil {
+		s += rl.mem.status(name)
+	}
+	if rl.disk != nil {
+		s += rl.disk.status(name + " (disk)")
+	}
+	return s
+}
+
+// allowRequest applies the global and site rate limits to a request. Clients
+// are identified by address, as seen through the trusted proxies of the site.
+func (sl *sitelist) allowRequest(req *http.Request, s *site, fromDisk bool, now time.Time) (bool, time.Duration) {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if s != nil && s.access != nil {
+		if ip := s.access.clientIP(req); ip != nil {
+			client = ip.String()
+		}
+	}
+
+	if ok, wait := sl.limits.allow(client, fromDisk, now); !ok {
+		return false, wait
+	}
+	if s != nil {
+		return s.limits.allow(client, fromDisk, now)
+	}
+	return true, 0
+}
+
+// servedFromDisk reports whether a request for the cleaned path p over scheme
+// would be served from disk, which decides the limit that applies. This is
+// only a lookup, so that it can be decided before fetch does any work.
+func (s *site) servedFromDisk(scheme, p string) bool {
+	if s == nil {
+		return false
+	}
+	rmap := s.http
+	if scheme == "https" {
+		rmap = s.https
+	}
+	if r, exists := rmap[p]; exists {
+		return r.spilled
+	}
+	return s.mountFor(p) != nil
+}
+
+// retryAfter formats a wait as a Retry-After value, rounding up to whole
+// seconds.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int((wait + time.Second - 1) / time.Second))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var (
+		t0 = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		l  = newLimiter(2, 3, 0)
+	)
+
+	tests := []struct {
+		key     string
+		elapsed time.Duration
+		ok      bool
+		wait    time.Duration
+	}{
+		// A new client starts with a full bucket.
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, false, 500 * time.Millisecond},
+		{"a", 250 * time.Millisecond, false, 250 * time.Millisecond},
+
+		// Tokens are refilled at the rate.
+		{"a", 500 * time.Millisecond, true, 0},
+		{"a", 500 * time.Millisecond, false, 500 * time.Millisecond},
+
+		// Clients have separate buckets.
+		{"b", 500 * time.Millisecond, true, 0},
+
+		// The bucket never holds more than the burst.
+		{"a", 10 * time.Second, true, 0},
+		{"a", 10 * time.Second, true, 0},
+		{"a", 10 * time.Second, true, 0},
+		{"a", 10 * time.Second, false, 500 * time.Millisecond},
+	}
+
+	for i, tt := range tests {
+		ok, wait := l.allow(tt.key, t0.Add(tt.elapsed))
+		if ok != tt.ok || wait != tt.wait {
+			t.Errorf("%d: allow(%q) at +%v = %v, %v, expected %v, %v", i, tt.key, tt.elapsed, ok, wait, tt.ok, tt.wait)
+		}
+	}
+}
+
+func TestNewLimiter(t *testing.T) {
+	if l := newLimiter(0, 10, 0); l != nil {
+		t.Errorf("newLimiter with rate 0 = %v, expected nil", l)
+	}
+	if l := newLimiter(2.5, 0, 0); l.burst != 3 || l.max != defaultMaxClients {
+		t.Errorf("newLimiter(2.5, 0, 0): burst %v and max %d, expected 3 and %d", l.burst, l.max, defaultMaxClients)
+	}
+}
+
+func TestLimiterBounded(t *testing.T) {
+	var (
+		now = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		l   = newLimiter(1, 1, 4)
+	)
+
+	// Every client uses up its bucket. As the limiter tracks at most 4
+	// clients, the table is rotated along the way.
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if ok, _ := l.allow(key, now); !ok {
+			t.Errorf("first request of %q limited", key)
+		}
+		if clients := len(l.cur) + len(l.prev); clients > l.max {
+			t.Errorf("%d clients tracked, expected at most %d", clients, l.max)
+		}
+	}
+
+	// Clients in the previous generation keep their bucket, while older ones
+	// have been forgotten, and start over with a full one.
+	for _, tt := range []struct {
+		key string
+		ok  bool
+	}{
+		{"c", false},
+		{"d", false},
+		{"e", false},
+		{"a", true},
+	} {
+		if ok, _ := l.allow(tt.key, now); ok != tt.ok {
+			t.Errorf("second request of %q: allowed %v, expected %v", tt.key, ok, tt.ok)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		s    string
+	}{
+		{0, "0"},
+		{time.Millisecond, "1"},
+		{time.Second, "1"},
+		{time.Second + time.Millisecond, "2"},
+		{time.Hour, "3600"},
+	}
+
+	for _, tt := range tests {
+		if s := retryAfter(tt.wait); s != tt.s {
+			t.Errorf("retryAfter(%v) = %q, expected %q", tt.wait, s, tt.s)
+		}
+	}
+}
+
+func TestHTTPRateLimit(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[rateLimit]
+rate = "1/h"
+burst = 1
+diskRate = "1/h"
+diskBurst = 2
+`,
+		"example.com/common/index.html": "hello",
+		"example.com/fancy/f/file.txt":  "from disk",
+	})
+
+	tests := []struct {
+		remote string
+		target string
+		status int
+	}{
+		{"192.0.2.1:1234", "http://example.com/", http.StatusOK},
+		{"192.0.2.1:1234", "http://example.com/", http.StatusTooManyRequests},
+		{"192.0.2.2:1234", "http://example.com/", http.StatusOK},
+
+		// From-disk resources have their own limit.
+		{"192.0.2.1:1234", "http://example.com/f/file.txt", http.StatusOK},
+		{"192.0.2.1:1234", "http://example.com/f/file.txt", http.StatusOK},
+		{"192.0.2.1:1234", "http://example.com/f/file.txt", http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		req.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		sl.http(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s from %s: status %d, expected %d", tt.target, tt.remote, w.Code, tt.status)
+			continue
+		}
+		if w.Code == http.StatusTooManyRequests {
+			if v := w.Header().Get("Retry-After"); v != "3600" {
+				t.Errorf("%s from %s: Retry-After %q, expected %q", tt.target, tt.remote, v, "3600")
+			}
+		}
+	}
+}
+
+func TestHTTPRateLimitBeforeAuth(t *testing.T) {
+	sl := newTestSitelist(t, map[string]string{
+		"example.com/config.toml": `
+[rateLimit]
+rate = "1/h"
+burst = 2
+
+[[auth]]
+path = "/private/"
+realm = "Private"
+file = "htpasswd"
+`,
+		"example.com/htpasswd":                  "alice:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\n",
+		"example.com/common/private/index.html": "private",
+	})
+
+	// Password guesses count against the limit like any other request.
+	for i, status := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		w := serve(sl, "GET", "http://example.com/private/", http.Header{"Authorization": {basicAuth("alice", "guess")}})
+		if w.Code != status {
+			t.Errorf("guess %d: status %d, expected %d", i, w.Code, status)
+		}
+	}
+}
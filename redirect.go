@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// acmeChallengePrefix is exempt from redirection to HTTPS, as ACME HTTP-01
+// challenges must be answered over plain HTTP.
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// redirectResource returns a resource redirecting to u with the given status.
+func redirectResource(u *url.URL, status int) *resource {
+	return &resource{
+		body:     []byte(http.StatusText(status) + "\n"),
+		cnttype:  "text/plain; charset=utf-8",
+		cache:    cacheControlNoCache,
+		location: u.String(),
+	}
+}
+
+// slashRedirect returns a resource redirecting a directory path to its
+// trailing-slash form.
+func slashRedirect(p, query string) (*resource, int) {
+	u := &url.URL{
+		Path:     p + "/",
+		RawQuery: query,
+	}
+	return redirectResource(u, http.StatusMovedPermanently), http.StatusMovedPermanently
+}
+
+// httpsRedirect returns a resource redirecting a request to its HTTPS
+// equivalent, using port unless it is 0 or the default. GET and HEAD are
+// redirected with 301, while other methods get 308, so that they are not
+// changed to GET.
+func httpsRedirect(req *http.Request, port int) (*resource, int) {
+	host := req.URL.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if port != 0 && port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	u := &url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+
+	status := http.StatusMovedPermanently
+	if req.Method != "GET" && req.Method != "HEAD" {
+		status = http.StatusPermanentRedirect
+	}
+
+	return redirectResource(u, status), status
+}
+
+// placeholderRegexp matches placeholders in the destination of a redirect
+// rule, such as :splat or :year.
+var placeholderRegexp = regexp.MustCompile(`:[A-Za-z_][A-Za-z0-9_]*`)
+
+// redirectRule is a compiled redirect rule, as read from a _redirects file or
+// the redirects section of the site configuration.
+type redirectRule struct {
+	// segments are the path segments of the source pattern. Segments starting
+	// with ":" are placeholders, matching any single segment.
+	segments []string
+
+	// splat is set if the source pattern ended with "*", matching any
+	// remaining segments.
+	splat bool
+
+	to     string
+	status int
+}
+
+// compileRedirect compiles a redirect rule.
+func compileRedirect(from, to string, status int) (*redirectRule, error) {
+	switch status {
+	case 0:
+		status = http.StatusMovedPermanently
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect, http.StatusGone:
+	default:
+		return nil, fmt.Errorf("%s: unsupported status %d", from, status)
+	}
+
+	if !strings.HasPrefix(from, "/") {
+		return nil, fmt.Errorf("%s: source must start with /", from)
+	}
+	if status != http.StatusGone {
+		if to == "" {
+			return nil, fmt.Errorf("%s: missing destination", from)
+		}
+		if _, err := url.Parse(to); err != nil {
+			return nil, fmt.Errorf("%s: %v", from, err)
+		}
+	}
+
+	rule := &redirectRule{
+		to:     to,
+		status: status,
+	}
+
+	from = strings.TrimSuffix(from, "/")
+	if strings.HasSuffix(from, "/*") {
+		rule.splat = true
+		from = from[:len(from)-2]
+	}
+	if from != "" {
+		rule.segments = strings.Split(from[1:], "/")
+	}
+
+	for _, seg := range rule.segments {
+		if strings.Contains(seg, "*") {
+			return nil, fmt.Errorf("/%s: * is only permitted as the last segment", strings.Join(rule.segments, "/"))
+		}
+	}
+
+	return rule, nil
+}
+
+// match matches a cleaned URL path against the rule. If it matches, the
+// destination with placeholders substituted is returned.
+func (rule *redirectRule) match(p string) (string, bool) {
+	p = strings.Trim(p, "/")
+
+	var segments []string
+	if p != "" {
+		segments = strings.Split(p, "/")
+	}
+
+	if len(segments) < len(rule.segments) || (!rule.splat && len(segments) != len(rule.segments)) {
+		return "", false
+	}
+
+	var values map[string]string
+	for i, seg := range rule.segments {
+		if strings.HasPrefix(seg, ":") {
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[seg] = url.PathEscape(segments[i])
+		} else if seg != segments[i] {
+			return "", false
+		}
+	}
+
+	if rule.splat {
+		if values == nil {
+			values = make(map[string]string)
+		}
+		rest := segments[len(rule.segments):]
+		for i := range rest {
+			rest[i] = url.PathEscape(rest[i])
+		}
+		values[":splat"] = strings.Join(rest, "/")
+	}
+
+	to := placeholderRegexp.ReplaceAllStringFunc(rule.to, func(s string) string {
+		if v, exists := values[s]; exists {
+			return v
+		}
+		return s
+	})
+
+	return to, true
+}
+
+// resource returns the resource for a request matching the rule, given the
+// destination returned by match. The query of the request is passed on, unless
+// the destination has its own. If the destination turns out to be invalid
+// after substitution, nil is returned.
+func (rule *redirectRule) resource(to, query string) (*resource, int) {
+	if rule.status == http.StatusGone {
+		return &resource{
+			body:    []byte(http.StatusText(http.StatusGone) + "\n"),
+			cnttype: "text/plain; charset=utf-8",
+			cache:   cacheControlNoCache,
+		}, http.StatusGone
+	}
+
+	u, err := url.Parse(to)
+	if err != nil {
+		return nil, 0
+	}
+	if u.RawQuery == "" {
+		u.RawQuery = query
+	}
+
+	return redirectResource(u, rule.status), rule.status
+}
+
+// readRedirects reads a _redirects file. Each line holds a source pattern, a
+// destination, and an optional status, separated by whitespace. Lines starting
+// with # are comments. Rules that cannot be compiled are returned as errors,
+// while the remaining rules are still returned.
+func readRedirects(p string) ([]*redirectRule, []error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, []error{err}
+	}
+
+	var (
+		rules []*redirectRule
+		errs  []error
+	)
+
+	for n, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var (
+			to     string
+			status int
+		)
+		switch len(fields) {
+		case 3:
+			if status, err = strconv.Atoi(fields[2]); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: invalid status %q", p, n+1, fields[2]))
+				continue
+			}
+			fallthrough
+		case 2:
+			to = fields[1]
+		default:
+			errs = append(errs, fmt.Errorf("%s:%d: expected source, destination and status", p, n+1))
+			continue
+		}
+
+		rule, err := compileRedirect(fields[0], to, status)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", p, n+1, err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, errs
+}
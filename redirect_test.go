@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCompileRedirect(t *testing.T) {
+	tests := []struct {
+		from, to string
+		status   int
+		ok       bool
+	}{
+		{"/a", "/b", 0, true},
+		{"/a/*", "/b/:splat", http.StatusFound, true},
+		{"/a/:x", "/b/:x", http.StatusPermanentRedirect, true},
+		{"/a", "", http.StatusGone, true},
+		{"a", "/b", 0, false},
+		{"/a", "", 0, false},
+		{"/a", "/b", http.StatusOK, false},
+		{"/a/*/b", "/c", 0, false},
+		{"/a*", "/c", 0, false},
+	}
+
+	for _, tt := range tests {
+		rule, err := compileRedirect(tt.from, tt.to, tt.status)
+		if (err == nil) != tt.ok {
+			t.Errorf("compileRedirect(%q, %q, %d): error %v, expected success %v", tt.from, tt.to, tt.status, err, tt.ok)
+			continue
+		}
+		if err == nil && tt.status == 0 && rule.status != http.StatusMovedPermanently {
+			t.Errorf("compileRedirect(%q, %q, 0): status %d, expected %d", tt.from, tt.to, rule.status, http.StatusMovedPermanently)
+		}
+	}
+}
+
+func TestRedirectMatch(t *testing.T) {
+	tests := []struct {
+		from, to string
+		path     string
+		dest     string
+		ok       bool
+	}{
+		{"/old", "/new", "/old", "/new", true},
+		{"/old/", "/new", "/old", "/new", true},
+		{"/old", "/new", "/old/", "/new", true},
+		{"/old", "/new", "/older", "", false},
+		{"/old", "/new", "/old/page", "", false},
+		{"/", "/new", "/", "/new", true},
+
+		// Splats match any remaining segments, including none.
+		{"/blog/*", "/posts/:splat", "/blog/2020/post", "/posts/2020/post", true},
+		{"/blog/*", "/posts/:splat", "/blog", "/posts/", true},
+		{"/blog/*", "/posts/:splat", "/news/2020", "", false},
+		{"/*", "https://example.com/:splat", "/a/b", "https://example.com/a/b", true},
+		{"/blog/*", "/posts/:splat", "/blog/a b/c?d", "/posts/a%20b/c%3Fd", true},
+
+		// Placeholders match a single segment.
+		{"/:year/:slug", "/posts/:slug?year=:year", "/2020/hello", "/posts/hello?year=2020", true},
+		{"/:year/:slug", "/posts/:slug", "/2020", "", false},
+		{"/:year/:slug", "/posts/:slug", "/2020/hello/more", "", false},
+		{"/tag/:name/*", "/tags/:name/:splat", "/tag/go/page/2", "/tags/go/page/2", true},
+		{"/tag/:name", "/tags/:name", "/tag/a%2Fb", "/tags/a%252Fb", true},
+
+		// Unknown placeholders are left alone.
+		{"/a/:x", "/b/:x/:y", "/a/1", "/b/1/:y", true},
+	}
+
+	for _, tt := range tests {
+		rule, err := compileRedirect(tt.from, tt.to, 0)
+		if err != nil {
+			t.Errorf("compileRedirect(%q, %q): %v", tt.from, tt.to, err)
+			continue
+		}
+		dest, ok := rule.match(tt.path)
+		if dest != tt.dest || ok != tt.ok {
+			t.Errorf("%s -> %s: match(%q) = %q, %v, expected %q, %v", tt.from, tt.to, tt.path, dest, ok, tt.dest, tt.ok)
+		}
+	}
+}
@@ -2,15 +2,16 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"mime"
+	"net/http"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -19,69 +20,149 @@ const (
 	cacheControlCache   = "public, max-age=%.0f"
 )
 
-func gz(b []byte) []byte {
-	buf := new(bytes.Buffer)
-	gz, _ := gzip.NewWriterLevel(buf, gzip.BestCompression)
-	gz.Write(b)
-	gz.Close()
-	return buf.Bytes()
-}
-
+// hash returns a strong entity-tag for b, derived from its SHA-256 sum. The
+// tag is quoted, as RFC 9110 requires.
 func hash(b []byte) string {
 	// You can't address into the return value of Sum256 without putting it into
 	// a variable first... GRR!
 	h := sha256.Sum256(b)
-	return hex.EncodeToString(h[:])
+	return "\"" + hex.EncodeToString(h[:]) + "\""
 }
 
-// cache stores bodies and hashes for deduplication during sitelist reload.
+// cache stores bodies, variants and hashes for deduplication during sitelist
+// reload. compressed is set if the variants include those we compressed
+// ourselves, rather than only precompressed sidecar files.
 type cache struct {
-	body  []byte
-	gbody []byte
-	hash  string
-	ghash string
+	body       []byte
+	hash       string
+	variants   []*variant
+	compressed bool
+}
+
+// encode produces the variants of the cached body from the precompressed
+// variants, compressing it for the other encodings if compress is set.
+// Variants that are not worth holding are not kept.
+func (c *cache) encode(precompressed map[*encoding]*variant, compress bool) {
+	c.variants = nil
+	for _, v := range encodeAll(c.body, precompressed, compress) {
+		if worthwhile(v, c.body) {
+			c.variants = append(c.variants, v)
+		}
+	}
+	c.compressed = compress
+}
+
+// precompressed returns the cached variants that come from precompressed
+// sidecar files.
+func (c *cache) precompressed() map[*encoding]*variant {
+	m := make(map[*encoding]*variant)
+	for _, v := range c.variants {
+		if v.path != "" {
+			m[v.encoding] = v
+		}
+	}
+	return m
+}
+
+// size returns the number of bytes held by the cached body and variants.
+func (c *cache) size() int64 {
+	n := int64(len(c.body))
+	for _, v := range c.variants {
+		n += int64(len(v.body))
+	}
+	return n
 }
 
 type resource struct {
-	path           string
-	body           []byte
-	gbody          []byte
-	bodyReadCloser io.ReadCloser
+	path     string
+	sitepath string
+	body     []byte
 
-	permitGZIP bool
-	fromDisk   bool
-	cache      string
-	cnttype    string
-	loaded     time.Time
-	config     *SiteConfig
+	// file and size are set for from-disk resources, which are streamed from
+	// the open file rather than held in memory. The modification time of the
+	// file is in loaded.
+	file *os.File
+	size int64
 
-	hash  string
-	ghash string
+	// spilled is set for files that did not fit in memory. They are kept in
+	// the resource maps without a body, and opened as from-disk resources on
+	// request.
+	spilled bool
+
+	// variants holds the encoded variants of the resource that are worth
+	// serving, in order of server preference. Variants of streaming resources
+	// carry no body, as they are encoded on the fly.
+	variants []*variant
+
+	fromDisk bool
+	cache    string
+	cnttype  string
+	sniffed  bool
+	vary     string
+	location string
+	headers  http.Header
+	loaded   time.Time
+	config   *SiteConfig
+
+	hash string
+}
+
+// readerAt returns an io.ReaderAt for the identity body of the resource, along
+// with its size.
+func (r *resource) readerAt() (io.ReaderAt, int64) {
+	if r.file != nil {
+		return r.file, r.size
+	}
+	return bytes.NewReader(r.body), int64(len(r.body))
+}
+
+// head returns up to the first sniffLen bytes of the identity body of the
+// resource.
+func (r *resource) head() []byte {
+	src, size := r.readerAt()
+	if src == nil {
+		return nil
+	}
+	if size > sniffLen {
+		size = sniffLen
+	}
+	b := make([]byte, size)
+	n, _ := src.ReadAt(b, 0)
+	return b[:n]
 }
 
 func (r *resource) updateTagCompress() {
 	r.hash = hash(r.body)
-	r.gbody = gz(r.body)
-	r.ghash = hash(r.gbody)
+	r.variants = encodeAll(r.body, nil, r.compressible())
 	r.update()
 }
 
 func (r *resource) update() {
 	var (
-		cache        time.Duration
-		cacheconf    = r.config.Cache
-		ext          = path.Ext(r.path)
-		compressconf = r.config.Compression
-		mincompsize  = compressconf.MinSize
+		cache     time.Duration
+		cacheconf = r.config.Cache
+		ext       = path.Ext(r.path)
 	)
 
-	if r.cnttype = mime.TypeByExtension(ext); r.cnttype == "" {
-		// Meh.
-		r.cnttype = "text/plain; charset=utf-8"
+	r.headers = r.config.Headers.evaluate(r.sitepath, ext)
+	if g := r.config.General; g.HSTSMaxAge > 0 {
+		// Explicitly configured headers take precedence. The header is only
+		// sent over TLS.
+		if r.headers == nil {
+			r.headers = make(http.Header)
+		}
+		if _, exists := r.headers["Strict-Transport-Security"]; !exists {
+			r.headers["Strict-Transport-Security"] = []string{fmt.Sprintf("max-age=%d", g.HSTSMaxAge)}
+		}
 	}
 
-	if compressconf.MinSize == 0 {
-		mincompsize = DefaultSiteConfig.Compression.MinSize
+	r.cnttype = contentType(ext, r.config)
+	r.sniffed = false
+	if g := r.config.General; ext == "" && g.SniffContentType {
+		if head := r.head(); len(head) > 0 {
+			r.cnttype = addCharset(sniffContentType(head), g.Charset)
+			r.sniffed = true
+		}
 	}
 
 	// Evaluate cache time.
@@ -101,33 +182,68 @@ func (r *resource) update() {
 		r.cache = fmt.Sprintf(cacheControlCache, cache.Seconds())
 	}
 
-	// Evaluate compression.
+	// Protected resources must not end up in shared caches.
+	if r.config.protects(r.sitepath) {
+		r.cache = "private" + strings.TrimPrefix(r.cache, "public")
+	}
+
+	// Evaluate compression. Clearing the variants allows them to be garbage
+	// collected, in case no resources decide to store them.
+	variants := r.variants
+	r.variants = nil
+	compress := r.compressible()
+
+	// Precompressed sidecar files cost nothing to serve, so they are used
+	// even where we would not compress ourselves.
+	for _, v := range variants {
+		if !compress && v.path == "" {
+			continue
+		}
+
+		if !r.fromDisk && !worthwhile(v, r.body) {
+			continue
+		}
+
+		r.variants = append(r.variants, v)
+	}
+}
+
+// compressible reports whether the compression settings of the resource allow
+// us to compress it.
+func (r *resource) compressible() bool {
+	var (
+		compressconf = r.config.Compression
+		mincompsize  = compressconf.MinSize
+		ext          = path.Ext(r.path)
+	)
+
+	if compressconf.MinSize == 0 {
+		mincompsize = DefaultSiteConfig.Compression.MinSize
+	}
+
 	if (r.fromDisk && compressconf.NoCompressFromDisk) ||
 		(!r.fromDisk && compressconf.NoCompressFromMem) ||
 		(r.body != nil && len(r.body) < mincompsize) {
-		return
+		return false
 	}
 
 	for _, v := range compressconf.Blacklist {
 		if ext == v {
-			return
+			return false
 		}
 	}
+	return true
+}
 
-	// If we know the size of the gzipped content already, we can evaluate if
-	// the gzip variant is worth the effort. If I math'd this right, then the
-	// threshold is a 10% size improvement. One could argue that ANY network
-	// benefit is worth pursuing, but if the benefit is less than 10%, the
-	// network benefit is negligible, and the server is basically just holding
-	// the file in memory twice.
-	if r.gbody != nil && float64(len(r.gbody))*1.1 >= float64(len(r.body)) {
-		// Clear gbody. In case no resources decide to store the gzipped entity
-		// variant, this allows for it to be garbage collected.
-		r.gbody = nil
-		return
-	}
-
-	r.permitGZIP = true
+// worthwhile reports whether the encoded variant v of body is worth holding in
+// memory. We know the size of the encoded variants of memory resources, so we
+// can evaluate if they are worth the effort. If I math'd this right, then the
+// threshold is a 10% size improvement. One could argue that ANY network
+// benefit is worth pursuing, but if the benefit is less than 10%, the network
+// benefit is negligible, and the server is basically just holding the file in
+// memory twice.
+func worthwhile(v *variant, body []byte) bool {
+	return float64(len(v.body))*1.1 < float64(len(body))
 }
 
 // site represents two sets of resources (one for HTTP, one for HTTPS) and a
@@ -135,61 +251,249 @@ func (r *resource) update() {
 // added to a sitelist, as access to them is intentionally not locked. Reloading
 // a must happen by replacing the site under sitelists' siteLock.
 type site struct {
-	http   map[string]*resource
-	https  map[string]*resource
-	config *SiteConfig
+	dir       string
+	http      map[string]*resource
+	https     map[string]*resource
+	redirects []*redirectRule
+	auth      []*authRule
+	access    *accessPolicy
+	cors      *corsPolicy
+	limits    *rateLimits
+	mounts    []*mount
+	filter    *fileFilter
+	budget    budget
+	spilled   []spill
+	config    *SiteConfig
 }
 
-func (s *site) addResource(diskpath, sitepath string, cachemap map[string]*cache, http, https bool) error {
+func (s *site) addResource(diskpath, sitepath string, cachemap map[string]*cache, global *budget, http, https bool) error {
 	fi, err := os.Stat(diskpath)
 	if err != nil {
 		return err
 	}
 
 	if fi.IsDir() {
-		diskpath = path.Join(diskpath, s.config.General.DefaultFile)
-		if fi, err = os.Stat(diskpath); err != nil || fi.IsDir() {
+		// Directories are served by their index file, which is registered
+		// under the trailing-slash form of the path. fetch redirects the
+		// slash-less form there, so relative links in the index work.
+		if !strings.HasSuffix(sitepath, "/") {
+			sitepath += "/"
+		}
+		dir := diskpath
+		keep := func(name string) bool {
+			return s.filter.excluded(s.dir, path.Join(dir, name), sitepath+name) == ""
+		}
+		if diskpath, fi = findIndex(dir, s.config.General, keep); fi == nil {
 			// We're here because the path addResource was called with was a
-			// directory, and the directory either lacked the default file, or
-			// the default file was a directory as well. Not being able to
-			// associate a default file with a directory is not an error, so we
+			// directory, and the directory either lacked an index file that
+			// may be served, or index files were disabled. Not being able to
+			// associate an index file with a directory is not an error, so we
 			// just skip the entry.
 			return nil
 		}
 	}
 
+	// Precompressed sidecar files are used as variants of the file they
+	// belong to, rather than being served on their own.
+	if sidecarOf(diskpath) != "" {
+		return nil
+	}
+
+	// Files that do not fit in memory are spilled, to be streamed from disk
+	// on request instead.
+	if reason := s.tooLarge(fi.Size(), global); reason != "" {
+		s.spill(diskpath, sitepath, fi, reason, http, https)
+		return nil
+	}
+
 	body, err := ioutil.ReadFile(diskpath)
 	if err != nil {
 		return err
 	}
 
 	r := &resource{
-		body:   body,
-		hash:   hash(body),
-		path:   diskpath,
-		config: s.config,
-		loaded: fi.ModTime(),
+		body:     body,
+		hash:     hash(body),
+		path:     diskpath,
+		sitepath: sitepath,
+		config:   s.config.forPath(sitepath),
+		loaded:   fi.ModTime(),
 	}
 
+	// We only compress the content if the resource may be served compressed,
+	// as compressing at the best levels is slow.
+	compress := r.compressible()
+
 	// Check if we already have this content read so we can deduplicate it.
+	// Sidecars are only read if we do not, as the variants we already have
+	// encode the same content. If we have it, but have not compressed it, it
+	// is compressed now.
+	//
+	// The memory budgets are charged for what the resource holds on to after
+	// update, as the variants it drops are garbage. Content we already hold
+	// costs nothing, but compressing it does, so the compressed variants are
+	// checked against the budgets like new content before they replace the
+	// cached ones.
 	if cached, exists := cachemap[r.hash]; exists {
 		r.body = cached.body
 		r.hash = cached.hash
-		r.gbody = cached.gbody
-		r.ghash = cached.ghash
+		r.variants = cached.variants
+
+		if !compress || cached.compressed {
+			r.update()
+		} else {
+			upgraded := &cache{
+				body: cached.body,
+				hash: cached.hash,
+			}
+			upgraded.encode(cached.precompressed(), true)
+
+			r.variants = upgraded.variants
+			r.update()
+			upgraded.variants = r.variants
+
+			growth := upgraded.size() - cached.size()
+			if reason := s.overBudget(growth, global); reason != "" {
+				s.spill(diskpath, sitepath, fi, reason, http, https)
+				return nil
+			}
+			s.budget.used += growth
+			global.used += growth
+
+			cached.variants = upgraded.variants
+			cached.compressed = true
+		}
 	} else {
-		r.gbody = gz(r.body)
-		r.ghash = hash(r.gbody)
+		// The plain body is checked before encoding, so that we do not
+		// compress files in vain, and the variants we keep are checked
+		// after.
+		if reason := s.overBudget(int64(len(body)), global); reason != "" {
+			s.spill(diskpath, sitepath, fi, reason, http, https)
+			return nil
+		}
+
+		c := &cache{
+			body: r.body,
+			hash: r.hash,
+		}
+		keep := s.filter.keepSidecar(s.dir, diskpath, sitepath)
+		c.encode(readSidecars(diskpath, fi, keep), compress)
+
+		r.variants = c.variants
+		r.update()
+		c.variants = r.variants
+
+		if reason := s.overBudget(c.size(), global); reason != "" {
+			s.spill(diskpath, sitepath, fi, reason, http, https)
+			return nil
+		}
+		s.budget.used += c.size()
+		global.used += c.size()
+
+		cachemap[r.hash] = c
+	}
+
+	if http {
+		s.http[sitepath] = r
+	}
+	if https {
+		s.https[sitepath] = r
+	}
+
+	return nil
+}
+
+// findIndex looks for an index file in the directory at diskpath. The default
+// file is tried first, followed by the index files in order. Files for which
+// keep returns false are treated as absent. If index files are disabled, or
+// none exist, a nil os.FileInfo is returned.
+func findIndex(diskpath string, g *SiteConfigGeneral, keep func(name string) bool) (string, os.FileInfo) {
+	if g.NoDefaultFile {
+		return "", nil
+	}
 
-		cachemap[r.hash] = &cache{
-			body:  r.body,
-			gbody: r.gbody,
-			hash:  r.hash,
-			ghash: r.ghash,
+	candidates := g.IndexFiles
+	if g.DefaultFile != "" {
+		candidates = append([]string{g.DefaultFile}, candidates...)
+	}
+
+	for _, name := range candidates {
+		if !keep(name) {
+			continue
 		}
+		p := path.Join(diskpath, name)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p, fi
+		}
+	}
+
+	return "", nil
+}
+
+// openResource opens the file at diskpath as a streaming resource served at
+// sitepath. If diskpath is a directory, the file is closed again, and only the
+// os.FileInfo is returned. Precompressed sidecar files do not exist as far as
+// openResource is concerned, and those of the file are only used if keep
+// returns true for their extension.
+func openResource(diskpath, sitepath string, config *SiteConfig, keep func(string) bool) (*resource, os.FileInfo, error) {
+	x, err := os.Open(diskpath)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	fi, err := x.Stat()
+	if err != nil || fi.IsDir() {
+		x.Close()
+		return nil, fi, err
+	}
+
+	if sidecarOf(diskpath) != "" {
+		x.Close()
+		return nil, nil, &os.PathError{Op: "open", Path: diskpath, Err: os.ErrNotExist}
+	}
+
+	// We make a streaming resource. The beefit of this is a much lower
+	// time-to-first-byte, as well as lower memory consumption. The file is
+	// sent as is, so its entity-tag is strong, which lets If-Range work. It is
+	// derived from the modification time in nanoseconds and the size, as
+	// hashing the file on every request would defeat the purpose.
+	r := &resource{
+		file:     x,
+		path:     diskpath,
+		sitepath: sitepath,
+		config:   config.forPath(sitepath),
+		size:     fi.Size(),
+		loaded:   fi.ModTime(),
+		hash:     fmt.Sprintf("\"%x-%x\"", fi.ModTime().UnixNano(), fi.Size()),
+		variants: streamVariants(diskpath, fi, keep),
+		fromDisk: true,
+	}
 	r.update()
+	return r, fi, nil
+}
+
+// spill registers the file at diskpath as a spilled resource served at
+// sitepath, recording the reason it is not held in memory.
+func (s *site) spill(diskpath, sitepath string, fi os.FileInfo, reason string, http, https bool) {
+	config := s.config.forPath(sitepath)
+	r := &resource{
+		path:     diskpath,
+		sitepath: sitepath,
+		config:   config,
+		cnttype:  contentType(path.Ext(diskpath), config),
+		size:     fi.Size(),
+		loaded:   fi.ModTime(),
+		spilled:  true,
+	}
+
+	// The content type is sniffed as for resources in memory, so that resource
+	// listings show what will be served.
+	if g := config.General; path.Ext(diskpath) == "" && g.SniffContentType {
+		if head := sniffFile(diskpath); len(head) > 0 {
+			r.cnttype = addCharset(sniffContentType(head), g.Charset)
+			r.sniffed = true
+		}
+	}
 
 	if http {
 		s.http[sitepath] = r
@@ -198,13 +502,89 @@ func (s *site) addResource(diskpath, sitepath string, cachemap map[string]*cache
 		s.https[sitepath] = r
 	}
 
-	return nil
+	s.spilled = append(s.spilled, spill{sitepath: sitepath, size: fi.Size(), reason: reason})
+}
+
+// get returns the resource at the path p of a resource map of the site.
+// Spilled resources are opened from disk. If that fails, the resource is
+// treated as not existing.
+func (s *site) get(rmap map[string]*resource, p string) (*resource, bool) {
+	res, exists := rmap[p]
+	if !exists || !res.spilled {
+		return res, exists
+	}
+
+	res, _, err := openResource(res.path, res.sitepath, s.config, s.filter.keepSidecar(s.dir, res.path, res.sitepath))
+	if err != nil || res == nil {
+		return nil, false
+	}
+	return res, true
+}
+
+// loadRedirects compiles the redirect rules of the site, first from the
+// _redirects file, then from the site configuration. Rules that cannot be
+// compiled are skipped and returned as errors.
+func (s *site) loadRedirects() []error {
+	rules, errs := readRedirects(path.Join(s.dir, "_redirects"))
+	for _, r := range s.config.Redirects {
+		rule, err := compileRedirect(r.From, r.To, r.Status)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config.toml: %v", err))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	s.redirects = rules
+	return errs
+}
+
+// loadAuth reads the htpasswd files of the auth rules of the site. Problems
+// with the files are returned as errors, but the rules are still installed,
+// denying access rather than granting it. Path blocks override the site
+// configuration, and later path blocks earlier ones, so their rules come
+// first, in reverse order. The rules of auth blocks follow, ordered by
+// descending prefix length, so that the first match is the longest.
+func (s *site) loadAuth() []error {
+	var (
+		errs  []error
+		paths []*authRule
+		rules []*authRule
+	)
+	for i := len(s.config.Path) - 1; i >= 0; i-- {
+		p := s.config.Path[i]
+		if p.Auth == nil {
+			continue
+		}
+		rule, ruleErrs := newAuthRule(*p.Auth, s.dir)
+		rule.match = p.Match
+		paths = append(paths, rule)
+		errs = append(errs, ruleErrs...)
+	}
+	for _, conf := range s.config.Auth {
+		rule, ruleErrs := newAuthRule(conf, s.dir)
+		rules = append(rules, rule)
+		errs = append(errs, ruleErrs...)
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+	s.auth = append(paths, rules...)
+
+	return errs
 }
 
-func newSite(config *SiteConfig) *site {
+func newSite(dir string, config *SiteConfig) *site {
+	rl := config.RateLimit
 	return &site{
+		dir:    dir,
 		http:   make(map[string]*resource),
 		https:  make(map[string]*resource),
+		limits: newRateLimits(rl.Rate.PerSecond, rl.Burst, rl.DiskRate.PerSecond, rl.DiskBurst, rl.MaxClients),
+		budget: budget{
+			limit:       config.Memory.Budget.Bytes,
+			maxFileSize: config.Memory.MaxFileSize.Bytes,
+		},
 		config: config,
 	}
 }
@@ -1,20 +1,22 @@
 package main
 
 import (
-	"compress/gzip"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"text/tabwriter"
 	"time"
 )
 
@@ -23,16 +25,25 @@ var (
 		body:    []byte("no such host"),
 		loaded:  time.Now(),
 		cnttype: "text/plain; charset=utf-8",
-		cache:   "public, max-age=0, no-cache",
+		cache:   cacheControlNoCache,
 		hash:    "W/\"go-far-away\"",
 		path:    "/403.html",
 	}
 
+	defaultForbidden = &resource{
+		body:    []byte("forbidden"),
+		loaded:  time.Now(),
+		cnttype: "text/plain; charset=utf-8",
+		cache:   cacheControlNoCache,
+		hash:    "W/\"go-elsewhere\"",
+		path:    "/403.html",
+	}
+
 	defaultNoSuchFile = &resource{
 		body:    []byte("no such file"),
 		loaded:  time.Now(),
 		cnttype: "text/plain; charset=utf-8",
-		cache:   "public, max-age=0, no-cache",
+		cache:   cacheControlNoCache,
 		hash:    "W/\"go-away\"",
 		path:    "/404.html",
 	}
@@ -67,15 +78,23 @@ type sitelist struct {
 	errNoSuchHost *resource
 	errNoSuchFile *resource
 
+	// diagnostics holds the problems encountered during the last load that
+	// did not prevent it from completing.
+	diagnostics []string
+
 	root        string
 	devmode     uint32
 	defaulthost string
+	limits      *rateLimits
+	compressed  *compressionCache
+	memory      budget
 	logger      func(string, ...interface{})
 
 	// stats
-	filesInMemory      int
-	plainBytesInMemory int
-	gzipBytesInMemory  int
+	denied               uint64
+	filesInMemory        int
+	plainBytesInMemory   int
+	encodedBytesInMemory map[string]int
 }
 
 func (sl *sitelist) access(req *http.Request, status int) {
@@ -109,10 +128,30 @@ func (sl *sitelist) status() string {
 	sl.siteLock.RLock()
 	defer sl.siteLock.RUnlock()
 
-	var sites string
+	var sites, encoded, spilled string
 
+	compressed := sl.compressed.status()
+	limits := sl.limits.status("Global")
+	memory := sl.memory.status("Global")
 	for host, site := range sl.sites {
-		sites += fmt.Sprintf("\t%s (%d HTTP resources, %d HTTPS resources)\n", host, len(site.http), len(site.https))
+		sites += fmt.Sprintf("\t%s (%d HTTP resources, %d HTTPS resources, %d redirects)\n", host, len(site.http), len(site.https), len(site.redirects))
+		limits += site.limits.status(host)
+		if site.budget.limit > 0 || site.budget.maxFileSize > 0 {
+			memory += site.budget.status(host)
+		}
+		for _, sp := range site.spilled {
+			spilled += fmt.Sprintf("\t%s%s (%s): %s\n", host, sp.sitepath, unitize(int(sp.size)), sp.reason)
+		}
+	}
+	if limits == "" {
+		limits = "\tNone\n"
+	}
+	if spilled == "" {
+		spilled = "\tNone\n"
+	}
+
+	for _, e := range encodings {
+		encoded += fmt.Sprintf("\t%-23s%s\n", "Total "+e.name+" file size:", unitize(sl.encodedBytesInMemory[e.name]))
 	}
 
 	return fmt.Sprintf(`
@@ -127,9 +166,17 @@ Settings:
 
 Stats:
 	Total plain file size: %s
-	Total gzip file size:  %s
-	Total files:           %d
-`,
+%s	Total files:           %d
+	Denied requests:       %d
+
+Memory:
+%s
+Spilled files:
+%s
+Compression cache:
+%s
+Rate limits:
+%s`,
 		len(sl.sites),
 		sites,
 		sl.root,
@@ -137,8 +184,82 @@ Stats:
 		sl.errNoSuchHost != nil,
 		sl.errNoSuchFile != nil,
 		unitize(sl.plainBytesInMemory),
-		unitize(sl.gzipBytesInMemory),
-		sl.filesInMemory)
+		encoded,
+		sl.filesInMemory,
+		atomic.LoadUint64(&sl.denied),
+		memory,
+		spilled,
+		compressed,
+		limits)
+}
+
+// resources returns a listing of the resources held in memory by every site,
+// with their content type and size. Content types that were sniffed rather
+// than derived from the extension are marked as such.
+func (sl *sitelist) resources() string {
+	sl.siteLock.RLock()
+	defer sl.siteLock.RUnlock()
+
+	hosts := make([]string, 0, len(sl.sites))
+	for host := range sl.sites {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var (
+		buf = new(bytes.Buffer)
+		tw  = tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	)
+	for _, host := range hosts {
+		s := sl.sites[host]
+		fmt.Fprintf(tw, "%s:\n", host)
+
+		paths := make(map[string]bool)
+		for p := range s.http {
+			paths[p] = true
+		}
+		for p := range s.https {
+			paths[p] = true
+		}
+		sorted := make([]string, 0, len(paths))
+		for p := range paths {
+			sorted = append(sorted, p)
+		}
+		sort.Strings(sorted)
+
+		for _, p := range sorted {
+			r, scheme := s.http[p], "http"
+			if hr, exists := s.https[p]; exists {
+				if r == hr {
+					scheme = "common"
+				} else if r == nil {
+					r, scheme = hr, "https"
+				} else {
+					fmt.Fprintf(tw, "\thttps\t%s\t%s\t%s\n", p, describeType(hr), describeSize(hr))
+				}
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t%s\t%s\n", scheme, p, describeType(r), describeSize(r))
+		}
+	}
+	tw.Flush()
+	return buf.String()
+}
+
+// describeType returns the content type of a resource for resource listings.
+func describeType(r *resource) string {
+	if r.sniffed {
+		return r.cnttype + " (sniffed)"
+	}
+	return r.cnttype
+}
+
+// describeSize returns the size of a resource for resource listings. Spilled
+// resources are marked as such, as they are not held in memory.
+func describeSize(r *resource) string {
+	if r.spilled {
+		return unitize(int(r.size)) + " (spilled)"
+	}
+	return unitize(len(r.body))
 }
 
 // dev flips the development mode switch.
@@ -150,50 +271,82 @@ func (sl *sitelist) dev(active bool) {
 	}
 }
 
-// fetch retrieves the file for a given URL. This is where the work happens, so
-// it must stay simple and fast.
-func (sl *sitelist) fetch(url *url.URL) (*resource, int) {
-	var (
-		host, p string
-		err     error
-		exists  bool
-		s       *site
-		res     *resource
-		rmap    map[string]*resource
-	)
+// forbidden returns the 403 document for a site. The 403 document is served
+// from 3 locations, as available:
+//
+// * The vhost directory itself, if available.
+// * The root directory itself, if available.
+// * The builtin default document.
+func (sl *sitelist) forbidden(req *http.Request, s *site) (*resource, int) {
+	rmap := s.http
+	if req.URL.Scheme == "https" {
+		rmap = s.https
+	}
+	if res, exists := s.get(rmap, "/403.html"); exists {
+		return res, http.StatusForbidden
+	}
 
-	if host, _, err = net.SplitHostPort(url.Host); err != nil {
-		host = url.Host
+	sl.siteLock.RLock()
+	res := sl.errNoSuchHost
+	sl.siteLock.RUnlock()
+	if res != nil {
+		return res, http.StatusForbidden
 	}
 
-	// If the devmode flag is set, we reload the entire sitelist. This is by far
-	// the easiest.
-	if atomic.LoadUint32(&sl.devmode) == 1 {
-		sl.load()
+	return defaultForbidden, http.StatusForbidden
+}
+
+// cleanPath cleans a URL path, but keeps a trailing slash, as directories are
+// registered with one.
+func cleanPath(p string) string {
+	cp := path.Clean(p)
+	if cp != "/" && strings.HasSuffix(p, "/") {
+		cp += "/"
+	}
+	return cp
+}
+
+// lookup returns the site for a host, falling back to the default host. If
+// neither exist, nil is returned.
+func (sl *sitelist) lookup(host string) *site {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
 
 	sl.siteLock.RLock()
-	s, exists = sl.sites[host]
+	s, exists := sl.sites[host]
+	if !exists {
+		s = sl.sites[sl.defaulthost]
+	}
 	sl.siteLock.RUnlock()
 
-	// Check if the host existed. If not, check the default host, and if that's not there either, return a 403
-	if !exists {
-		sl.siteLock.RLock()
-		s, exists = sl.sites[sl.defaulthost]
-		sl.siteLock.RUnlock()
-		if !exists {
-			if sl.errNoSuchHost != nil {
-				return sl.errNoSuchHost, http.StatusForbidden
-			}
-			return defaultNoSuchHost, http.StatusForbidden
+	return s
+}
+
+// fetch retrieves the file for a given request to a site, as found by lookup.
+// This is where the work happens, so it must stay simple and fast.
+func (sl *sitelist) fetch(req *http.Request, s *site) (*resource, int) {
+	var (
+		p      string
+		exists bool
+		res    *resource
+		rmap   map[string]*resource
+		url    = req.URL
+	)
+
+	// If the host did not exist, and there was no default host, return a 403.
+	if s == nil {
+		if sl.errNoSuchHost != nil {
+			return sl.errNoSuchHost, http.StatusForbidden
 		}
+		return defaultNoSuchHost, http.StatusForbidden
 	}
 
 	// TODO(kl): Consider moving this to the from-disk branch. That means that
 	// /meticulous/../fantastical will not render correctly as /fantastical, but
 	// I do not really find this to be an issue. It could shave some cycles off
 	// in-memory resource fetch.
-	p = path.Clean(url.Path)
+	p = cleanPath(url.Path)
 
 	// First, let's try for the file in memory. If it's found, we return it
 	// immediately. This is the path we want to be the fastest.
@@ -204,39 +357,53 @@ func (sl *sitelist) fetch(url *url.URL) (*resource, int) {
 		rmap = s.http
 	}
 
-	if res, exists = rmap[p]; exists {
+	if res, exists = s.get(rmap, p); exists {
 		return res, 200
 	}
 
-	// The file was not in memory, so see if it's available in the from-disk
-	// folder. We first verify if the path prefix matches the permitted
-	// from-disk prefix, and if so, try to load the resource directly, without
-	// storing it in the resource map. The source is loaded from the "fancy"
-	// folder of the vhost directory.
-	if strings.HasPrefix(p, s.config.General.FancyFolder) {
-		p = path.Join(sl.root, host, "fancy", p)
-
-		// We make a streaming resource. The beefit of this is a much lower
-		// time-to-first-byte, as well as lower memory consumption.
-		if x, err := os.Open(p); err == nil {
-			if fi, err := x.Stat(); err == nil && !fi.IsDir() {
-				res = &resource{
-					bodyReadCloser: x,
-					path:           p,
-					config:         s.config,
-					loaded:         fi.ModTime(),
-					hash:           fmt.Sprintf("W/\"%x-%xi\"", fi.ModTime().Unix(), fi.Size()),
-					ghash:          fmt.Sprintf("W/\"%x-%xg\"", fi.ModTime().Unix(), fi.Size()),
-					fromDisk:       true,
-					permitGZIP:     true,
-				}
-				res.update()
-				return res, 200
+	// Directories are registered with a trailing slash. Redirect to it, so
+	// that relative links work.
+	if !strings.HasSuffix(p, "/") {
+		if _, exists = rmap[p+"/"]; exists {
+			return slashRedirect(p, url.RawQuery)
+		}
+	}
+
+	// The file was not in memory, so see if it's available from disk. The
+	// mount with the longest prefix matching the path is used, and the
+	// resource is loaded directly, without storing it in the resource map. The
+	// from-disk folder is such a mount, serving from the "fancy" folder of the
+	// vhost directory.
+	if m := s.mountFor(p); m != nil {
+		if res, status := sl.fetchDisk(req, s, m, p); res != nil {
+			return res, status
+		}
+	}
+
+	// Redirect rules only apply to paths that would otherwise be not found, so
+	// they cannot shadow content.
+	for _, rule := range s.redirects {
+		if to, matched := rule.match(p); matched {
+			if res, status := rule.resource(to, url.RawQuery); res != nil {
+				return res, status
 			}
+		}
+	}
 
-			// We couldn't use the file, so close it up and continue to file not
-			// found handling.
-			x.Close()
+	// Single-page applications route on the client, so unknown paths are
+	// served the application itself, unless excluded.
+	if fallback := s.config.General.SPAFallback; fallback != "" {
+		excluded := false
+		for _, prefix := range s.config.General.SPAExclude {
+			if strings.HasPrefix(p, prefix) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			if res, exists = s.get(rmap, fallback); exists {
+				return res, 200
+			}
 		}
 	}
 
@@ -247,7 +414,7 @@ func (sl *sitelist) fetch(url *url.URL) (*resource, int) {
 	// * The root directory itself, if available.
 	// * The configured default document.
 	//
-	if res, exists = rmap["/404.html"]; exists {
+	if res, exists = s.get(rmap, "/404.html"); exists {
 		return res, http.StatusNotFound
 	}
 
@@ -258,14 +425,66 @@ func (sl *sitelist) fetch(url *url.URL) (*resource, int) {
 	return defaultNoSuchFile, http.StatusNotFound
 }
 
+// fetchDisk retrieves the resource for the cleaned path p from a mount of a
+// site. If there is none, or the file filter of the site excludes it, nil is
+// returned.
+func (sl *sitelist) fetchDisk(req *http.Request, s *site, m *mount, p string) (*resource, int) {
+	diskpath, ok := m.resolve(p)
+	if !ok || s.filter.excluded(m.dir, diskpath, p) != "" {
+		return nil, 0
+	}
+
+	res, fi, err := openResource(diskpath, p, m.config, s.filter.keepSidecar(m.dir, diskpath, p))
+	switch {
+	case err != nil:
+		// Continue to file not found handling.
+	case res != nil && strings.HasSuffix(p, "/"):
+		// A file cannot be a directory.
+		res.file.Close()
+	case res != nil:
+		return res, 200
+	case !strings.HasSuffix(p, "/"):
+		return slashRedirect(p, req.URL.RawQuery)
+	default:
+		// Directories are served by their index file, or as a listing, if
+		// enabled.
+		keepIndex := func(name string) bool {
+			return s.filter.excluded(m.dir, path.Join(diskpath, name), p+name) == ""
+		}
+		if indexpath, _ := findIndex(diskpath, m.config.General, keepIndex); indexpath != "" {
+			if res, _, err = openResource(indexpath, p, m.config, s.filter.keepSidecar(m.dir, indexpath, p)); err == nil && res != nil {
+				return res, 200
+			}
+		}
+
+		if m.config.General.AutoIndex {
+			keep := func(name string, fi os.FileInfo) bool {
+				sp := p + name
+				if fi.IsDir() {
+					sp += "/"
+				}
+				return s.filter.excluded(m.dir, path.Join(diskpath, name), sp) == ""
+			}
+			accept, _ := quickHeaderGet("Accept", req.Header)
+			if res, err = indexResource(diskpath, p, fi, strings.Contains(accept, "application/json"), m.config, keep); err == nil {
+				return res, 200
+			}
+			sl.logger("Cannot list %s: %v\n", diskpath, err)
+		}
+	}
+
+	return nil, 0
+}
+
 // http is the actual HTTP handler, serving the requests as quickly as it can.
 // It implements http.Handler.
 func (sl *sitelist) http(w http.ResponseWriter, req *http.Request) {
 	var (
-		head, exists, useGZIP bool
-		now                   = time.Now()
-		h                     = w.Header()
-		err                   error
+		head, exists bool
+		enc          *encoding
+		now          = time.Now()
+		h            = w.Header()
+		err          error
 	)
 
 	// We patch up the URL object for convenience.
@@ -276,83 +495,297 @@ func (sl *sitelist) http(w http.ResponseWriter, req *http.Request) {
 		req.URL.Scheme = "http"
 	}
 
-	// Evaluate method
-	switch req.Method {
-	case "GET":
-		// do nothing
-	case "HEAD":
-		head = true
-	default:
-		h["Content-Type"] = []string{"text/plain; charset=utf-8"}
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write(nil) // Do I need to call Write? :/
-		sl.access(req, http.StatusMethodNotAllowed)
-		return
+	// If the devmode flag is set, we reload the entire sitelist. This is by far
+	// the easiest.
+	if atomic.LoadUint32(&sl.devmode) == 1 {
+		sl.load()
 	}
 
-	r, status := sl.fetch(req.URL)
+	var (
+		r      *resource
+		status int
+		s      = sl.lookup(req.URL.Host)
+	)
+
+	// Sites that redirect to HTTPS do so for every request and method, before
+	// looking at anything else. Address restrictions come right after.
+	if s != nil && req.URL.Scheme == "http" && s.config.General.RedirectToHTTPS &&
+		!strings.HasPrefix(req.URL.Path, acmeChallengePrefix) {
+		r, status = httpsRedirect(req, s.config.General.HTTPSPort)
+	} else if s != nil && s.access != nil && !s.access.permits(req, cleanPath(req.URL.Path)) {
+		atomic.AddUint64(&sl.denied, 1)
+		r, status = sl.forbidden(req, s)
+	} else {
+		// CORS preflights are answered directly. Browsers send them without
+		// credentials, so they must not be subject to authentication.
+		if req.Method == "OPTIONS" && s != nil && s.cors != nil {
+			if _, exists = quickHeaderGet("Access-Control-Request-Method", req.Header); exists {
+				s.cors.preflight(h, req.Header, cleanPath(req.URL.Path))
+				w.WriteHeader(http.StatusNoContent)
+				sl.access(req, http.StatusNoContent)
+				return
+			}
+		}
+
+		// Evaluate method
+		switch req.Method {
+		case "GET":
+			// do nothing
+		case "HEAD":
+			head = true
+		default:
+			h["Content-Type"] = []string{"text/plain; charset=utf-8"}
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write(nil) // Do I need to call Write? :/
+			sl.access(req, http.StatusMethodNotAllowed)
+			return
+		}
 
-	hash := r.hash
-	body := r.body
-	if r.permitGZIP {
-		var acceptEncoding string
-		if acceptEncoding, exists = quickHeaderGet("Accept-Encoding", req.Header); exists && strings.Contains(acceptEncoding, "gzip") {
-			useGZIP = true
-			body = r.gbody
-			hash = r.ghash
-			h["Content-Encoding"] = []string{"gzip"}
+		// Rate limits are applied before authentication, so that password
+		// guessing is limited too, and before fetch, so that limited requests
+		// cause no disk work.
+		if ok, wait := sl.allowRequest(req, s, s.servedFromDisk(req.URL.Scheme, cleanPath(req.URL.Path)), now); !ok {
+			h["Retry-After"] = []string{retryAfter(wait)}
+			h["Content-Type"] = []string{"text/plain; charset=utf-8"}
+			h["Cache-Control"] = []string{cacheControlNoCache}
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(http.StatusText(http.StatusTooManyRequests) + "\n"))
+			sl.access(req, http.StatusTooManyRequests)
+			return
 		}
+
+		// Protected paths require authentication before we even look for
+		// the resource, so that we do not reveal what exists.
+		if s != nil && len(s.auth) > 0 {
+			if a := s.authFor(cleanPath(req.URL.Path)); a != nil {
+				if user, ok := a.check(req.Header); !ok {
+					if user != "" {
+						sl.logger("[%s]: authentication failed for user %q on %s\n", req.RemoteAddr, user, req.URL.Path)
+					}
+					h["Www-Authenticate"] = []string{a.challenge()}
+					h["Content-Type"] = []string{"text/plain; charset=utf-8"}
+					h["Cache-Control"] = []string{cacheControlNoCache}
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(http.StatusText(http.StatusUnauthorized) + "\n"))
+					sl.access(req, http.StatusUnauthorized)
+					return
+				}
+			}
+		}
+
+		r, status = sl.fetch(req, s)
+	}
+	if r.file != nil {
+		defer r.file.Close()
 	}
 
-	// Set headers
+	// Additional headers are set first, so that they cannot break the headers
+	// we depend on. Strict-Transport-Security must only be sent over TLS, as
+	// per RFC 6797, so it is left out of plain HTTP responses, even if set
+	// explicitly.
+	for k, v := range r.headers {
+		h[k] = v
+	}
+	if req.TLS == nil {
+		delete(h, "Strict-Transport-Security")
+	}
+
+	// Range requests are always served from the identity representation. The
+	// encoded variants of a streaming resource are produced on the fly, and can
+	// therefore not be addressed by offset, and using the identity
+	// representation for both kinds of resources keeps the rule simple. A
+	// Range header we do not understand is ignored, as RFC 7233 permits.
+	var (
+		ranges   []httpRange
+		rangeErr error
+	)
+	src, size := r.readerAt()
+	if status == http.StatusOK && src != nil {
+		var rangeHeader string
+		if rangeHeader, exists = quickHeaderGet("Range", req.Header); exists && r.ifRange(req.Header) {
+			ranges, rangeErr = parseRange(rangeHeader, size)
+		}
+	}
+
+	// Pick the representation to serve. If the client refuses identity, we
+	// cannot serve a range, and fall back to a full response instead.
+	var (
+		hash       = r.hash
+		body       = r.body
+		accept     = getAcceptEncoding(req.Header)
+		candidates = r.variants
+	)
+	if ranges != nil || rangeErr != nil {
+		if accept.quality("identity") > 0 {
+			candidates = nil
+		} else {
+			ranges, rangeErr = nil, nil
+		}
+	}
+
+	v, acceptable := accept.negotiate(candidates)
+
+	// Precompressed sidecar files of from-disk resources are opened here, so
+	// that we can fall back to another representation if that fails.
+	var sidecar *os.File
+	if v != nil && v.body == nil && v.path != "" {
+		if sidecar, err = os.Open(v.path); err != nil {
+			sl.logger("Cannot open %s: %v\n", v.path, err)
+			v, acceptable = accept.negotiate(withoutSidecars(candidates))
+		} else {
+			defer sidecar.Close()
+		}
+	}
+	if !acceptable && status == http.StatusOK {
+		h["Content-Type"] = []string{"text/plain; charset=utf-8"}
+		h["Vary"] = []string{"Accept-Encoding"}
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("no acceptable content-coding\n"))
+		sl.access(req, http.StatusNotAcceptable)
+		return
+	}
+
+	// For error documents, we disregard the Accept-Encoding header rather
+	// than turning the error into a 406, as RFC 9110 permits.
+	if v != nil {
+		enc = v.encoding
+		body = v.body
+		hash = v.hash
+		h["Content-Encoding"] = []string{enc.name}
+	}
+
+	// Set headers. A Last-Modified in the future is not permitted, which can
+	// happen if a file has a bogus mtime.
+	modified := r.loaded
+	if modified.After(now) {
+		modified = now
+	}
 	h["Content-Type"] = []string{r.cnttype}
-	h["Date"] = []string{now.Format(time.RFC1123)}
+	h["Date"] = []string{now.UTC().Format(http.TimeFormat)}
 	h["Cache-Control"] = []string{r.cache}
-	h["Last-Modified"] = []string{r.loaded.Format(time.RFC1123)}
-	h["Etag"] = []string{hash}
-	h["Vary"] = []string{"Accept-Encoding"}
-
-	// Should we send a 304 Not Modified? We do this if the file was found, and
-	// the cache information headers from the client match the file we have
-	// available. 304's are, annoyingly so, only partially like HEAD request, as
-	// it does not contain encoding and length information about the payload
-	// like a HEAD does. This means we have to interrupt the request at
-	// different points of their execution... *sigh*
+	if !modified.IsZero() {
+		h["Last-Modified"] = []string{modified.UTC().Format(http.TimeFormat)}
+	}
+	if hash != "" {
+		h["Etag"] = []string{hash}
+	}
+	if r.location != "" {
+		h["Location"] = []string{r.location}
+	}
+	vary := r.vary
+	if vary == "" {
+		vary = "Accept-Encoding"
+	}
+	if s != nil && s.cors != nil {
+		p := cleanPath(req.URL.Path)
+		s.cors.apply(h, req.Header, p)
+		if s.cors.varies(p) {
+			vary += ", Origin"
+		}
+	}
+	h["Vary"] = []string{vary}
+	if status == http.StatusOK && src != nil {
+		h["Accept-Ranges"] = []string{"bytes"}
+	}
+
+	// Evaluate preconditions against the selected representation. We only do
+	// so for resources that exist, as error documents are not what the
+	// validators of the client refer to.
 	if status == http.StatusOK {
-		var cacheResponse bool
-		var ifNoneMatch, ifModifiedSince string
-		if ifNoneMatch, exists = quickHeaderGet("If-None-Match", req.Header); exists {
-			cacheResponse = ifNoneMatch == r.hash || ifNoneMatch == "*"
-		} else if ifModifiedSince, exists = quickHeaderGet("If-Modified-Since", req.Header); exists {
-			var imsdate time.Time
-			imsdate, err = time.Parse(time.RFC1123, ifModifiedSince)
-			cacheResponse = err == nil && !imsdate.IsZero() && imsdate.After(r.loaded)
-		}
-
-		if cacheResponse {
-			w.WriteHeader(http.StatusNotModified)
-			sl.access(req, http.StatusNotModified)
+		if cs := checkPreconditions(req.Header, req.Method, hash, modified); cs != 0 {
+			if cs == http.StatusPreconditionFailed {
+				h["Content-Length"] = []string{"0"}
+			}
+			w.WriteHeader(cs)
+			sl.access(req, cs)
 			return
 		}
 	}
 
-	// Are we dealing with a streaming resource (That is, a file)?
-	if r.bodyReadCloser != nil {
+	if rangeErr != nil {
+		h["Content-Range"] = []string{fmt.Sprintf("bytes */%d", size)}
+		h["Content-Length"] = []string{"0"}
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		sl.access(req, http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if ranges != nil {
+		write := rangeResponse(h, src, size, ranges, r.cnttype)
+		w.WriteHeader(http.StatusPartialContent)
+		sl.access(req, http.StatusPartialContent)
+		if head {
+			return
+		}
+
+		if err = write(w); err != nil {
+			sl.logger("[%s]: error writing response: %v\n", req.RemoteAddr, err)
+		}
+		return
+	}
+
+	// Are we dealing with a file? Files small enough for the compression
+	// cache are compressed once, and then served like memory resources. HEAD
+	// requests do not need a body, so they do not fill the cache, but are
+	// served from it if the body is there, so that they get the same headers
+	// as GET requests.
+	var cached bool
+	if r.file != nil && enc != nil && sidecar == nil && sl.compressed.cacheable(r.size) {
+		key := sl.compressed.key(r.path, v)
+		if head {
+			body, cached = sl.compressed.peek(key)
+		} else {
+			if body, err = sl.compressed.get(key, enc, r.file); err != nil {
+				sl.logger("[%s]: cannot compress %s: %v\n", req.RemoteAddr, r.path, err)
+				for _, k := range []string{"Content-Encoding", "Etag", "Last-Modified", "Accept-Ranges"} {
+					delete(h, k)
+				}
+				h["Content-Type"] = []string{"text/plain; charset=utf-8"}
+				h["Cache-Control"] = []string{cacheControlNoCache}
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(http.StatusText(http.StatusInternalServerError) + "\n"))
+				sl.access(req, http.StatusInternalServerError)
+				return
+			}
+			cached = true
+		}
+	}
+	if r.file != nil && !cached {
+		// The identity representation and sidecar files have a known
+		// length, and are copied straight from the file, which lets the
+		// kernel send them with sendfile. Only responses encoded on the fly
+		// are sent chunked.
+		var (
+			src    *os.File
+			length int64
+		)
+		switch {
+		case sidecar != nil:
+			src, length = sidecar, v.size
+		case enc == nil:
+			src, length = r.file, r.size
+		}
+		if src != nil {
+			h["Content-Length"] = []string{strconv.FormatInt(length, 10)}
+		}
+
 		w.WriteHeader(status)
 		sl.access(req, status)
 		if head {
 			return
 		}
 
-		if useGZIP {
-			gz := gzip.NewWriter(w)
-			_, err = io.Copy(gz, r.bodyReadCloser)
-			gz.Close()
+		if src != nil {
+			_, err = io.CopyN(w, src, length)
 		} else {
-			_, err = io.Copy(w, r.bodyReadCloser)
+			ew := enc.writer(w)
+			if _, err = io.Copy(ew, r.file); err == nil {
+				err = ew.Close()
+			}
+		}
+		if err != nil {
+			sl.logger("[%s]: error writing response: %v\n", req.RemoteAddr, err)
 		}
-		sl.logger("[%s]: error writing response: %v\n", req.RemoteAddr, err)
-		r.bodyReadCloser.Close()
 		return
 	}
 
@@ -395,12 +828,23 @@ func (sl *sitelist) cmdhttp(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		sl.siteLock.RLock()
+		diagnostics := sl.diagnostics
+		sl.siteLock.RUnlock()
+
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write([]byte("OK\n"))
+		for _, d := range diagnostics {
+			w.Write([]byte(d + "\n"))
+		}
 	case "/status":
 		sl.logger("[%s]: status request\n", req.RemoteAddr)
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write([]byte(sl.status()))
+	case "/resources":
+		sl.logger("[%s]: resources request\n", req.RemoteAddr)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(sl.resources()))
 	default:
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Unknown command\n"))
@@ -429,9 +873,15 @@ func (sl *sitelist) load() error {
 		sites         = make(map[string]*site)
 		errNoSuchHost *resource
 		errNoSuchFile *resource
-		n             = time.Now()
+		diagnostics   []string
 	)
 
+	diagnose := func(format string, v ...interface{}) {
+		d := fmt.Sprintf(format, v...)
+		sl.logger("%s\n", d)
+		diagnostics = append(diagnostics, d)
+	}
+
 	// list root
 	files, err := ioutil.ReadDir(sl.root)
 	if err != nil {
@@ -440,6 +890,12 @@ func (sl *sitelist) load() error {
 
 	cachemap := make(map[string]*cache)
 
+	// The memory budget is accounted from scratch for every load.
+	sl.siteLock.RLock()
+	memory := sl.memory
+	sl.siteLock.RUnlock()
+	memory.used = 0
+
 	for _, s := range files {
 		name := s.Name()
 		p := path.Join(sl.root, name)
@@ -447,9 +903,10 @@ func (sl *sitelist) load() error {
 		// If we found a directory, check if it's a server global resource.
 		if !s.IsDir() {
 			res := &resource{
-				path:   p,
-				config: &DefaultSiteConfig,
-				loaded: n,
+				path:     p,
+				sitepath: "/" + name,
+				config:   &DefaultSiteConfig,
+				loaded:   s.ModTime(),
 			}
 
 			switch name {
@@ -482,9 +939,37 @@ func (sl *sitelist) load() error {
 			sl.logger("Cannot read configuration for %s, using default: %v\n", name, err)
 		}
 
-		s := newSite(conf)
+		s := newSite(p, conf)
 		sites[name] = s
 
+		// Keep the state of the rate limits of the site across reloads, as
+		// long as they have not been reconfigured.
+		sl.siteLock.RLock()
+		old, exists := sl.sites[name]
+		sl.siteLock.RUnlock()
+		if exists && *old.config.RateLimit == *conf.RateLimit {
+			s.limits = old.limits
+		}
+
+		for _, err := range s.loadRedirects() {
+			diagnose("%s: invalid redirect: %v", name, err)
+		}
+		for _, err := range s.loadFilter() {
+			diagnose("%s: %v", name, err)
+		}
+		for _, err := range s.loadMounts() {
+			diagnose("%s: mount: %v", name, err)
+		}
+		for _, err := range s.loadAuth() {
+			diagnose("%s: auth: %v", name, err)
+		}
+		if s.access, err = newAccessPolicy(conf.Access); err != nil {
+			return fmt.Errorf("%s: access: %v", name, err)
+		}
+		if s.cors, err = newCORSPolicy(conf.CORS); err != nil {
+			return fmt.Errorf("%s: cors: %v", name, err)
+		}
+
 		for _, c := range schemes {
 			if !c.IsDir() {
 				continue
@@ -493,6 +978,13 @@ func (sl *sitelist) load() error {
 			scheme := c.Name()
 			http := scheme == "http" || scheme == "common"
 			https := scheme == "https" || scheme == "common"
+
+			// Files in other directories, such as "fancy", are served from
+			// disk, so there is no point in loading them.
+			if !http && !https {
+				continue
+			}
+
 			start := path.Join(sl.root, name, scheme)
 			err := filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
 				if err != nil {
@@ -504,7 +996,23 @@ func (sl *sitelist) load() error {
 					p2 = "/"
 				}
 
-				return s.addResource(p, p2, cachemap, http, https)
+				// Excluded directories are skipped as a whole. They are
+				// matched with a trailing slash, as they are served.
+				if p2 != "/" {
+					sp := p2
+					if info.IsDir() {
+						sp += "/"
+					}
+					if reason := s.filter.excluded(s.dir, p, sp); reason != "" {
+						diagnose("%s: excluded %s%s: %s", name, scheme, sp, reason)
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+				}
+
+				return s.addResource(p, p2, cachemap, &memory, http, https)
 			})
 
 			if err != nil {
@@ -513,10 +1021,17 @@ func (sl *sitelist) load() error {
 		}
 	}
 
-	var plainInMemory, gzipInMemory int
+	var (
+		plainInMemory   int
+		encodedInMemory = make(map[string]int)
+	)
+	// The cache only holds the variants that resources kept, so this is
+	// what is actually in memory.
 	for _, v := range cachemap {
 		plainInMemory += len(v.body)
-		gzipInMemory += len(v.gbody)
+		for _, vr := range v.variants {
+			encodedInMemory[vr.encoding.name] += len(vr.body)
+		}
 	}
 
 	// We're done, so install the results.
@@ -524,9 +1039,11 @@ func (sl *sitelist) load() error {
 	sl.sites = sites
 	sl.errNoSuchFile = errNoSuchFile
 	sl.errNoSuchHost = errNoSuchHost
+	sl.diagnostics = diagnostics
+	sl.memory = memory
 	sl.filesInMemory = len(cachemap)
 	sl.plainBytesInMemory = plainInMemory
-	sl.gzipBytesInMemory = gzipInMemory
+	sl.encodedBytesInMemory = encodedInMemory
 	sl.siteLock.Unlock()
 
 	// We might have created a lot of garbage, so just run the GC now.